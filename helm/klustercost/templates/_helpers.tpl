@@ -38,3 +38,53 @@ Usage: include "klustercost.componentSelectorLabels" (dict "context" . "componen
 {{ include "klustercost.selectorLabels" .context }}
 app.kubernetes.io/component: {{ .component }}
 {{- end -}}
+
+{{/*
+Transform directory of an observed group/version/resource: resource.group,
+or resource for the core group.
+Usage: include "klustercost.observedResourceDir" "karpenter.sh/v1/nodeclaims"
+*/}}
+{{- define "klustercost.observedResourceDir" -}}
+{{- $parts := splitList "/" . -}}
+{{- if eq (len $parts) 3 -}}
+{{ index $parts 2 }}.{{ index $parts 0 }}
+{{- else -}}
+{{ last $parts }}
+{{- end -}}
+{{- end -}}
+
+{{/*
+Transform directories of all the observed kinds and resources, one per line.
+*/}}
+{{- define "klustercost.observedTransformDirs" -}}
+{{- range .Values.monitor.observedKinds }}
+{{ . }}
+{{- end }}
+{{- range .Values.monitor.observedResources }}
+{{ include "klustercost.observedResourceDir" . }}
+{{- end }}
+{{- end -}}
+
+{{/*
+Headers of the Prometheus queries as the comma separated Name=value list of PROMETHEUS_HEADERS.
+Usage: include "klustercost.prometheusHeaders" .Values.prometheus.headers
+*/}}
+{{- define "klustercost.prometheusHeaders" -}}
+{{- $headers := list -}}
+{{- range $name, $value := . -}}
+{{- $headers = append $headers (printf "%s=%s" $name $value) -}}
+{{- end -}}
+{{- join "," $headers -}}
+{{- end -}}
+
+{{/*
+Prometheus server of the monitor, empty unless a transform queries Prometheus:
+the prometheus usage source, volumeStats or the cluster metricsQueryMode.
+Usage: include "klustercost.prometheusServer" .
+*/}}
+{{- define "klustercost.prometheusServer" -}}
+{{- $monitor := .Values.monitor -}}
+{{- if or (eq $monitor.usageSource "prometheus") $monitor.volumeStats (eq $monitor.metricsQueryMode "cluster") -}}
+{{- required "monitor: usageSource prometheus, volumeStats and metricsQueryMode cluster need prometheus.prometheusServerAddress" .Values.prometheus.prometheusServerAddress -}}
+{{- end -}}
+{{- end -}}
@@ -0,0 +1,39 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+var kubeClient kubernetes.Interface
+
+// SetKubernetesClient hands the client of the API server to the usage sources
+// served by Kubernetes rather than Prometheus
+func SetKubernetesClient(client kubernetes.Interface) {
+	kubeClient = client
+}
+
+// PodMetrics lists the usage of all the pods from the metrics.k8s.io API of metrics-server
+func PodMetrics(ctx context.Context) ([]byte, error) {
+	if kubeClient == nil {
+		return nil, fmt.Errorf("no Kubernetes client for the metrics-server source")
+	}
+	return kubeClient.CoreV1().RESTClient().Get().
+		AbsPath("/apis/metrics.k8s.io/v1beta1/pods").
+		DoRaw(ctx)
+}
+
+// KubeletSummary reads the stats summary of the kubelet of a node through the API server proxy
+func KubeletSummary(ctx context.Context, node string) ([]byte, error) {
+	if kubeClient == nil {
+		return nil, fmt.Errorf("no Kubernetes client for the kubelet source")
+	}
+	return kubeClient.CoreV1().RESTClient().Get().
+		Resource("nodes").
+		Name(node).
+		SubResource("proxy").
+		Suffix("stats/summary").
+		DoRaw(ctx)
+}
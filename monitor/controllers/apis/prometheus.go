@@ -1,25 +1,98 @@
 package controller
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
 	env "klustercost/monitor/pkg/env"
 
 	prometheusApi "github.com/prometheus/client_golang/api"
 	prometheusv1 "github.com/prometheus/client_golang/api/prometheus/v1"
-	"k8s.io/klog/v2"
+	"github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
 )
 
 var prometheusapi prometheusv1.API
 
-func init() {
-	prometheusclient, err := prometheusApi.NewClient(prometheusApi.Config{Address: env.EnvironmentVariables.PrometheusServer})
+// NewPrometheusAPI creates the client of the Prometheus server from the
+// configuration. Token, password and certificate files are read again on
+// every query, so rotated credentials apply without a restart.
+func NewPrometheusAPI(settings *env.EnvVars) error {
+	httpConfig := config.DefaultHTTPClientConfig
+	httpConfig.BearerToken = config.Secret(settings.PromToken)
+	httpConfig.BearerTokenFile = settings.PromTokenFile
+	if settings.PromUsername != "" {
+		httpConfig.BasicAuth = &config.BasicAuth{
+			Username:     settings.PromUsername,
+			Password:     config.Secret(settings.PromPassword),
+			PasswordFile: settings.PromPasswordFile,
+		}
+	}
+	httpConfig.TLSConfig = config.TLSConfig{
+		CAFile:             settings.PromCAFile,
+		CertFile:           settings.PromCertFile,
+		KeyFile:            settings.PromKeyFile,
+		InsecureSkipVerify: settings.PromInsecure,
+	}
+	if err := httpConfig.Validate(); err != nil {
+		return err
+	}
+
+	roundTripper, err := config.NewRoundTripperFromConfig(httpConfig, "klustercost-monitor")
+	if err != nil {
+		return err
+	}
+	headers, err := settings.PrometheusHeaders()
+	if err != nil {
+		return err
+	}
+	if len(headers) > 0 {
+		roundTripper = &headerRoundTripper{headers: headers, next: roundTripper}
+	}
+
+	prometheusclient, err := prometheusApi.NewClient(prometheusApi.Config{
+		Address:      settings.PrometheusServer,
+		RoundTripper: roundTripper,
+	})
 	if err != nil {
-		//TODO: ctx and logger should be passed in here instead of using klog directly
-		klog.Error(err, "Unable to create Prometheus client")
-		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		return err
 	}
 	prometheusapi = prometheusv1.NewAPI(prometheusclient)
+	return nil
+}
+
+// Query runs an instant query, bounded by the configured timeout on both
+// the Prometheus server and the client side
+func Query(ctx context.Context, query string, ts time.Time) (model.Value, error) {
+	if prometheusapi == nil {
+		return nil, fmt.Errorf("no Prometheus server configured for query %s", query)
+	}
+	timeout := time.Duration(env.EnvironmentVariables.PromTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result, _, err := prometheusapi.Query(ctx, query, ts, prometheusv1.WithTimeout(timeout))
+	return result, err
 }
 
-func GetPrometheusAPI() prometheusv1.API {
-	return prometheusapi
+// PingPrometheus checks that the Prometheus server answers a trivial query
+func PingPrometheus(ctx context.Context) error {
+	_, err := Query(ctx, "1", time.Now())
+	return err
+}
+
+// headerRoundTripper adds the configured headers, e.g. the tenant of Mimir or Cortex
+type headerRoundTripper struct {
+	headers http.Header
+	next    http.RoundTripper
+}
+
+func (rt *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, values := range rt.headers {
+		req.Header[name] = values
+	}
+	return rt.next.RoundTrip(req)
 }
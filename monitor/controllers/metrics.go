@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"klustercost/monitor/pkg/health"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// A worker busy with one item for longer than this is considered stuck.
+// Items wait at most for a few Prometheus queries and a database statement.
+const stuckWorkerThreshold = 5 * time.Minute
+
+var (
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "klustercost_workqueue_depth",
+		Help: "Number of items waiting in the workqueue.",
+	}, []string{"name"})
+	queueAdds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "klustercost_workqueue_adds_total",
+		Help: "Number of items added to the workqueue.",
+	}, []string{"name"})
+	queueLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "klustercost_workqueue_queue_duration_seconds",
+		Help:    "Time an item waits in the workqueue before being processed.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"name"})
+	queueWorkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "klustercost_workqueue_work_duration_seconds",
+		Help:    "Time spent processing an item.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"name"})
+	queueUnfinished = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "klustercost_workqueue_unfinished_work_seconds",
+		Help: "Time spent so far on the items being processed.",
+	}, []string{"name"})
+	queueLongestRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "klustercost_workqueue_longest_running_processor_seconds",
+		Help: "Time spent so far on the oldest item being processed.",
+	}, []string{"name"})
+	queueRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "klustercost_workqueue_retries_total",
+		Help: "Number of items requeued after a failure.",
+	}, []string{"name"})
+
+	writeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "klustercost_persistence_write_duration_seconds",
+		Help:    "Time the controllers spend handing a record to the persistence, by outcome.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"controller", "op", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(queueDepth, queueAdds, queueLatency, queueWorkDuration,
+		queueUnfinished, queueLongestRunning, queueRetries, writeDuration)
+	workqueue.SetProvider(queueMetrics)
+	health.AddLivenessCheck("workers", queueMetrics.stuck)
+}
+
+// queueMetricsProvider feeds the workqueue metrics to Prometheus and keeps
+// the longest running item of every queue to detect stuck workers.
+type queueMetricsProvider struct {
+	lock    sync.Mutex
+	longest map[string]float64
+}
+
+var queueMetrics = &queueMetricsProvider{longest: make(map[string]float64)}
+
+func (p *queueMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return queueDepth.WithLabelValues(name)
+}
+
+func (p *queueMetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return queueAdds.WithLabelValues(name)
+}
+
+func (p *queueMetricsProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return queueLatency.WithLabelValues(name)
+}
+
+func (p *queueMetricsProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return queueWorkDuration.WithLabelValues(name)
+}
+
+func (p *queueMetricsProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return queueUnfinished.WithLabelValues(name)
+}
+
+func (p *queueMetricsProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return &longestRunningGauge{Gauge: queueLongestRunning.WithLabelValues(name), name: name, provider: p}
+}
+
+func (p *queueMetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return queueRetries.WithLabelValues(name)
+}
+
+// stuck fails when a worker of any queue has been busy with one item for too long
+func (p *queueMetricsProvider) stuck() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for name, seconds := range p.longest {
+		if seconds > stuckWorkerThreshold.Seconds() {
+			return fmt.Errorf("a worker of queue %s has been processing one item for %.0fs", name, seconds)
+		}
+	}
+	return nil
+}
+
+type longestRunningGauge struct {
+	prometheus.Gauge
+	name     string
+	provider *queueMetricsProvider
+}
+
+func (g *longestRunningGauge) Set(seconds float64) {
+	g.Gauge.Set(seconds)
+	g.provider.lock.Lock()
+	g.provider.longest[g.name] = seconds
+	g.provider.lock.Unlock()
+}
+
+// observeWrite records how long a persistence call of a controller took
+func observeWrite(controller string, op string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	writeDuration.WithLabelValues(controller, op, result).Observe(time.Since(start).Seconds())
+}
+
+// cacheSynced is a readiness check passing once all the informers synced
+func cacheSynced(synced ...cache.InformerSynced) health.Check {
+	return func() error {
+		for _, hasSynced := range synced {
+			if !hasSynced() {
+				return fmt.Errorf("informer cache not synced")
+			}
+		}
+		return nil
+	}
+}
@@ -1,190 +1,61 @@
 package controller
 
 import (
-	"context"
 	"fmt"
+	transform "klustercost/monitor/controllers/templates"
 	"klustercost/monitor/pkg/model"
 	"klustercost/monitor/pkg/persistence"
-	"klustercost/monitor/pkg/signals"
-	"strings"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/runtime"
-	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
-	"k8s.io/client-go/kubernetes"
-	corelisters "k8s.io/client-go/listers/core/v1"
-	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/util/workqueue"
-	"k8s.io/klog/v2"
 )
 
-type NodeController struct {
-	kubeclientset kubernetes.Interface
-	nodesLister   corelisters.NodeLister
-	nodesSynced   cache.InformerSynced
-	nodequeue     workqueue.RateLimitingInterface
-}
-
-func NewNodeController(
-	kubeclientset kubernetes.Interface,
-	informer informers.SharedInformerFactory) *NodeController {
-
-	nodesInformer := informer.Core().V1().Nodes()
-
-	nc := &NodeController{
-		kubeclientset: kubeclientset,
-		nodesLister:   nodesInformer.Lister(),
-		nodesSynced:   nodesInformer.Informer().HasSynced,
-		nodequeue:     workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Nodes")}
-
-	_, err := nodesInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: nc.enqueueNode,
-		UpdateFunc: func(old, new interface{}) {
-			nc.enqueueNode(new)
+// NewNodeController observes the nodes through the /node/ transform. Its
+// nodes are also the ones whose kubelets the kubelet usage source reads.
+func NewNodeController(informer informers.SharedInformerFactory) *ResourceController {
+	nodes := informer.Core().V1().Nodes()
+	transform.SetNodeLister(nodes.Lister())
+
+	return NewResourceController(ResourceConfig{
+		Kind:          model.KindNode,
+		Informer:      nodes.Informer(),
+		TransformPath: "/node/",
+		Persist: func(node_json string) error {
+			return persistence.GetPersistInterface().InsertNodeJson(node_json)
+		},
+		Terminate: func(obj interface{}) *model.Termination {
+			node, ok := obj.(*v1.Node)
+			if !ok {
+				runtime.HandleError(fmt.Errorf("unexpected object in node deletion %#v", obj))
+				return nil
+			}
+			return nodeTermination(node)
 		},
 	})
-	if err != nil {
-		signals.Logger.Error(err, "Klustercost:  unable to fetch nodes")
-		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
-	}
-
-	return nc
-}
-
-func (nc *NodeController) enqueueNode(obj interface{}) {
-	node := obj.(*v1.Node)
-	nc.nodequeue.Add(node.ObjectMeta.Name)
-}
-
-func (nc *NodeController) Run(workers int) error {
-
-	defer runtime.HandleCrash()
-
-	signals.Logger.Info("Klustercost: Starting node observer threads")
-
-	// Wait for the caches to be synced before starting workers
-	signals.Logger.Info("Waiting for node informer caches to sync")
-
-	if ok := cache.WaitForCacheSync(signals.Ctx.Done(), nc.nodesSynced); !ok {
-		return fmt.Errorf("failed to wait for node caches to sync")
-	}
-
-	signals.Logger.Info("Starting workers for nodes", "count", workers)
-	for i := 0; i < workers; i++ {
-		go wait.UntilWithContext(signals.Ctx, nc.runWorker, time.Second)
-	}
-
-	signals.Logger.Info("Done")
-
-	return nil
-}
-
-// runWorker runs a worker to process items from the workqueue
-func (nc *NodeController) runWorker(ctx context.Context) {
-	for nc.processNextWorkItem(ctx) {
-	}
 }
 
-// processNextWorkItem processes items from the workqueue
-func (nc *NodeController) processNextWorkItem(context.Context) bool {
-	obj, shutdown := nc.nodequeue.Get()
-
-	if shutdown {
-		return false
-	}
-	// We wrap this block in a func so we can defer c.workqueue.Done.
-	err := func(obj interface{}) error {
-		defer nc.nodequeue.Done(obj)
-		var key string
-		var ok bool
-		// We expect strings to come off the workqueue. These are of the
-		// form namespace/name. We do this as the delayed nature of the
-		// workqueue means the items in the informer cache may actually be
-		// more up to date that when the item was initially put onto the
-		// workqueue.
-		if key, ok = obj.(string); !ok {
-			// As the item in the workqueue is actually invalid, we call
-			// Forget here else we'd go into a loop of attempting to
-			// process a work item that is invalid.
-			nc.nodequeue.Forget(obj)
-			runtime.HandleError(fmt.Errorf("expected string in workqueue but got %#v", obj))
-			return nil
-		}
-		nodeName, err := cache.ParseObjectName(key)
-		if err != nil {
-			runtime.HandleError(fmt.Errorf("invalid resource key: %s", key))
-			return nil
-		}
-
-		nodeMisc := nc.getNodeMiscellaneous(nodeName.Name)
-
-		err = persistence.GetPersistInterface().InsertNode(nodeName.Name, nodeMisc)
-
-		if err != nil {
-			nc.nodequeue.AddRateLimited(obj)
-			runtime.HandleError(fmt.Errorf("invalid resource key: %s", key))
-			return nil
+// nodeTermination builds the end of life record of a node from its last known Ready condition
+func nodeTermination(node *v1.Node) *model.Termination {
+	finalState := string(v1.ConditionUnknown)
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			if condition.Status == v1.ConditionTrue {
+				finalState = "Ready"
+			} else {
+				finalState = "NotReady"
+			}
 		}
-
-		nc.nodequeue.Forget(obj)
-
-		return nil
-	}(obj)
-
-	if err != nil {
-		runtime.HandleError(err)
-		return true
-	}
-
-	return true
-}
-
-// Returns the friendly name of the controller
-func (nc *NodeController) FriendlyName() string {
-	return "NodeController"
-}
-
-// getNodeMiscellaneous returns the node creation time, memory, cpu and UID
-func (nc *NodeController) getNodeMiscellaneous(name string) *model.NodeMisc {
-	node, err := nc.nodesLister.Get(name)
-	if err != nil {
-		signals.Logger.Error(err, "Error getting node lister ")
 	}
 
-	nodeMisc := &model.NodeMisc{}
-
-	nodeMisc.Memory = float64(node.Status.Capacity.Memory().Value()) / 1024 / 1024
-	nodeMisc.CPU = float64(node.Status.Capacity.Cpu().Value())
-	nodeMisc.UID = string(node.ObjectMeta.UID)
-	nodeMisc.Labels = NodeLabelSelector(node.Labels)
-	nodeMisc.InstanceType = node.Labels["node.kubernetes.io/instance-type"]
-	nodeMisc.Region = node.Labels["topology.kubernetes.io/region"]
-	nodeMisc.Zone = node.Labels["topology.kubernetes.io/zone"]
-	nodeMisc.OS = node.Labels["kubernetes.io/os"]
-
-	return nodeMisc
-}
-
-// NodeLabelSelector returns a string with the labels of a node
-func NodeLabelSelector(labels map[string]string) string {
-	var nodeLabels = []string{"node.kubernetes.io/instance-type", "topology.kubernetes.io/region", "topology.kubernetes.io/zone", "kubernetes.io/os"}
-	var sb strings.Builder
-
-	for _, label := range nodeLabels {
-		value, exists := labels[label]
-		sb.WriteString(label)
-		if exists {
-			sb.WriteString("=")
-			sb.WriteString(value)
-		}
-		sb.WriteString(",")
-	}
-	// Remove the trailing comma
-	result := sb.String()
-	if len(result) > 0 {
-		result = result[:len(result)-1]
+	return &model.Termination{
+		ObjectRef: model.ObjectRef{
+			Kind: model.KindNode,
+			UID:  string(node.UID),
+			Name: node.Name,
+		},
+		Timestamp:  time.Now(),
+		FinalState: finalState,
 	}
-	return result
 }
@@ -0,0 +1,147 @@
+package controller
+
+import (
+	"fmt"
+	"klustercost/monitor/pkg/observer"
+	"klustercost/monitor/pkg/persistence"
+	"klustercost/monitor/pkg/signals"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// observableKind is a kind that can be listed in OBSERVED_KINDS
+type observableKind struct {
+	kind     string
+	informer func(informers.SharedInformerFactory) cache.SharedIndexInformer
+}
+
+// The kinds recorded by a ResourceController, by resource name. The resource
+// name is also the transform directory, e.g. /services/labels.jsonata.
+var observableKinds = map[string]observableKind{
+	"namespaces": {"Namespace", func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return f.Core().V1().Namespaces().Informer()
+	}},
+	"services": {"Service", func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return f.Core().V1().Services().Informer()
+	}},
+	"persistentvolumeclaims": {"PersistentVolumeClaim", func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return f.Core().V1().PersistentVolumeClaims().Informer()
+	}},
+	"persistentvolumes": {"PersistentVolume", func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return f.Core().V1().PersistentVolumes().Informer()
+	}},
+	"deployments": {"Deployment", func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return f.Apps().V1().Deployments().Informer()
+	}},
+	"statefulsets": {"StatefulSet", func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return f.Apps().V1().StatefulSets().Informer()
+	}},
+	"daemonsets": {"DaemonSet", func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return f.Apps().V1().DaemonSets().Informer()
+	}},
+	"jobs": {"Job", func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return f.Batch().V1().Jobs().Informer()
+	}},
+	"cronjobs": {"CronJob", func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return f.Batch().V1().CronJobs().Informer()
+	}},
+}
+
+// NewObservedControllers creates a ResourceController for every resource of
+// the comma separated list, e.g. "namespaces,services"
+func NewObservedControllers(resources string, informer informers.SharedInformerFactory) ([]observer.Controller, error) {
+	var controllers []observer.Controller
+	for _, resource := range strings.Split(resources, ",") {
+		resource = strings.ToLower(strings.TrimSpace(resource))
+		if resource == "" {
+			continue
+		}
+		observable, exists := observableKinds[resource]
+		if !exists {
+			return nil, fmt.Errorf("unknown kind %s in OBSERVED_KINDS", resource)
+		}
+
+		kind := observable.kind
+		controllers = append(controllers, NewResourceController(ResourceConfig{
+			Kind:          kind,
+			Informer:      observable.informer(informer),
+			TransformPath: "/" + resource + "/",
+			Persist: func(object_json string) error {
+				return persistence.GetPersistInterface().InsertObjectJson(kind, object_json)
+			},
+		}))
+	}
+	return controllers, nil
+}
+
+// ParseResources parses a comma separated list of group/version/resource,
+// e.g. "karpenter.sh/v1/nodeclaims,argoproj.io/v1alpha1/rollouts". Resources
+// of the core group are written version/resource.
+func ParseResources(resources string) ([]schema.GroupVersionResource, error) {
+	var result []schema.GroupVersionResource
+	for _, resource := range strings.Split(resources, ",") {
+		resource = strings.TrimSpace(resource)
+		if resource == "" {
+			continue
+		}
+		parts := strings.Split(resource, "/")
+		switch len(parts) {
+		case 2:
+			result = append(result, schema.GroupVersionResource{Version: parts[0], Resource: parts[1]})
+		case 3:
+			result = append(result, schema.GroupVersionResource{Group: parts[0], Version: parts[1], Resource: parts[2]})
+		default:
+			return nil, fmt.Errorf("%s in OBSERVED_RESOURCES is not group/version/resource", resource)
+		}
+	}
+	return result, nil
+}
+
+// NewDynamicControllers creates a ResourceController for every resource, watched
+// through the dynamic informer factory. Objects are recorded with the kind
+// resource.group, e.g. nodeclaims.karpenter.sh, which is also the transform
+// directory. Resources the API server does not serve, such as CRDs that are not
+// installed, are skipped so they do not hold up the other controllers.
+func NewDynamicControllers(
+	resources []schema.GroupVersionResource,
+	discovery discovery.DiscoveryInterface,
+	informer dynamicinformer.DynamicSharedInformerFactory) []observer.Controller {
+
+	var controllers []observer.Controller
+	for _, gvr := range resources {
+		if !isServed(discovery, gvr) {
+			signals.Logger.Error(fmt.Errorf("resource not served by the API server"), "Skipping observed resource", "resource", gvr.String())
+			continue
+		}
+
+		kind := gvr.GroupResource().String()
+		controllers = append(controllers, NewResourceController(ResourceConfig{
+			Kind:          kind,
+			Informer:      informer.ForResource(gvr).Informer(),
+			TransformPath: "/" + kind + "/",
+			Persist: func(object_json string) error {
+				return persistence.GetPersistInterface().InsertObjectJson(kind, object_json)
+			},
+		}))
+	}
+	return controllers
+}
+
+// isServed checks the discovery documents for the resource
+func isServed(discovery discovery.DiscoveryInterface, gvr schema.GroupVersionResource) bool {
+	list, err := discovery.ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+	if err != nil {
+		return false
+	}
+	for _, resource := range list.APIResources {
+		if resource.Name == gvr.Resource {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"klustercost/monitor/pkg/model"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// maxOwnerDepth bounds the ownerReferences walk so that a cycle in
+// (possibly hand-written) owner references cannot hang a worker.
+const maxOwnerDepth = 10
+
+// ownerResolver walks the ownerReferences of a pod up to its top-level
+// workload using the informer listers. Only the intermediate kinds that
+// the resolver knows how to look up (ReplicaSet, Job) are followed; any
+// other owner, including CRDs, is considered top-level.
+type ownerResolver struct {
+	replicaSetsLister appslisters.ReplicaSetLister
+	replicaSetsSynced cache.InformerSynced
+	jobsLister        batchlisters.JobLister
+	jobsSynced        cache.InformerSynced
+}
+
+func newOwnerResolver(informer informers.SharedInformerFactory) *ownerResolver {
+	replicaSetInformer := informer.Apps().V1().ReplicaSets()
+	jobInformer := informer.Batch().V1().Jobs()
+
+	return &ownerResolver{
+		replicaSetsLister: replicaSetInformer.Lister(),
+		replicaSetsSynced: replicaSetInformer.Informer().HasSynced,
+		jobsLister:        jobInformer.Lister(),
+		jobsSynced:        jobInformer.Informer().HasSynced,
+	}
+}
+
+// Returns the informers the resolver depends on, to be waited for before resolving
+func (r *ownerResolver) synced() []cache.InformerSynced {
+	return []cache.InformerSynced{r.replicaSetsSynced, r.jobsSynced}
+}
+
+// resolve returns the top-level controller of the pod.
+// A pod without a controller owner is its own top-level controller.
+func (r *ownerResolver) resolve(pod *v1.Pod) *model.Controller {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		return &model.Controller{Kind: "Pod", Name: pod.Name, UID: string(pod.UID)}
+	}
+
+	for range maxOwnerDepth {
+		next := r.parentOf(pod.Namespace, ref)
+		if next == nil {
+			break
+		}
+		ref = next
+	}
+
+	return &model.Controller{Kind: ref.Kind, Name: ref.Name, UID: string(ref.UID)}
+}
+
+// parentOf returns the controller reference of the object referenced by ref,
+// or nil when ref is top-level or the object is not in the informer cache.
+func (r *ownerResolver) parentOf(namespace string, ref *metav1.OwnerReference) *metav1.OwnerReference {
+	var owner metav1.Object
+
+	switch ref.Kind {
+	case "ReplicaSet":
+		replicaSet, err := r.replicaSetsLister.ReplicaSets(namespace).Get(ref.Name)
+		if err != nil {
+			return nil
+		}
+		owner = replicaSet
+	case "Job":
+		job, err := r.jobsLister.Jobs(namespace).Get(ref.Name)
+		if err != nil {
+			return nil
+		}
+		owner = job
+	default:
+		return nil
+	}
+
+	// A recreated object with the same name is not the one we were pointed at
+	if owner.GetUID() != ref.UID {
+		return nil
+	}
+
+	return metav1.GetControllerOf(owner)
+}
@@ -2,17 +2,20 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	transform "klustercost/monitor/controllers/templates"
 	"klustercost/monitor/pkg/env"
+	"klustercost/monitor/pkg/health"
+	"klustercost/monitor/pkg/model"
 	"klustercost/monitor/pkg/persistence"
 	"klustercost/monitor/pkg/signals"
-
+	"sync/atomic"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/runtime"
-	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	corelisters "k8s.io/client-go/listers/core/v1"
@@ -26,6 +29,21 @@ type PodController struct {
 	podsLister    corelisters.PodLister
 	podsSynced    cache.InformerSynced
 	podqueue      workqueue.RateLimitingInterface
+	owners        *ownerResolver
+	sampler       *sampler
+	cycle         *transform.Cycle
+	transforms    *transform.TransformWatcher
+	// Set while Run is active, so standby replicas queue no terminations
+	running atomic.Bool
+}
+
+// podSource is the object handed to the labels.jsonata transform:
+// the pod itself plus the top-level workload that owns it.
+type podSource struct {
+	*v1.Pod
+	Controller *model.Controller `json:"controller,omitempty"`
+	// Seconds since the previous sample of the pod, absent for its first sample
+	SampleInterval float64 `json:"sampleInterval,omitempty"`
 }
 
 func NewPodController(
@@ -33,33 +51,132 @@ func NewPodController(
 	informer informers.SharedInformerFactory) *PodController {
 
 	podInformer := informer.Core().V1().Pods()
+	var err error
 
 	controller := &PodController{
 		kubeclientset: kubeclientset,
 		podsLister:    podInformer.Lister(),
 		podsSynced:    podInformer.Informer().HasSynced,
-		podqueue:      workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Pods")}
+		podqueue:      workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Pods"),
+		owners:        newOwnerResolver(informer),
+		cycle:         transform.NewCycle()}
+	controller.sampler = newSampler(
+		time.Second*time.Duration(env.EnvironmentVariables.SampleInterval),
+		env.EnvironmentVariables.SampleJitter,
+		func(key string) { controller.podqueue.Add(key) },
+		controller.cycle.Start)
+
+	controller.transforms, err = transform.NewTransformWatcher(
+		signals.Ctx,
+		env.EnvironmentVariables.TransformPath+controller.baseTransformPath())
+	if err != nil {
+		signals.Logger.Error(err, "Klustercost: invalid pod transform")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
 
-	_, err := podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: controller.enqueuePod,
+	// Informer events only maintain the inventory of running pods,
+	// the sampler decides when they are sampled
+	_, err = podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: controller.trackPod,
 		UpdateFunc: func(old, new interface{}) {
-			controller.enqueuePod(new)
+			controller.trackPod(new)
+			if podFinished(new.(*v1.Pod)) && !podFinished(old.(*v1.Pod)) {
+				controller.enqueueTermination(podTermination(new.(*v1.Pod)))
+			}
 		},
+		DeleteFunc: controller.enqueuePodDeletion,
 	})
 	if err != nil {
 		signals.Logger.Error(err, "Klustercost:  unable to fetch pods")
 		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
+	health.AddReadinessCheck(controller.FriendlyName(), cacheSynced(append(controller.owners.synced(), controller.podsSynced)...))
 
 	return controller
 }
 
-func (c *PodController) enqueuePod(obj interface{}) {
+// trackPod keeps running pods, and only them, in the sampling inventory
+func (c *PodController) trackPod(obj interface{}) {
 	pod := obj.(*v1.Pod)
-	c.podqueue.Add(pod.ObjectMeta.Namespace + "/" + pod.ObjectMeta.Name)
+	if pod.Status.Phase == v1.PodRunning {
+		c.sampler.track(podKey(pod))
+	} else {
+		c.sampler.untrack(podKey(pod))
+	}
+}
+
+func podKey(pod *v1.Pod) string {
+	return pod.ObjectMeta.Namespace + "/" + pod.ObjectMeta.Name
+}
+
+// enqueuePodDeletion queues the end of life record of a deleted pod.
+// When the watch missed the deletion, the informer hands over a tombstone
+// holding the last known state of the pod.
+func (c *PodController) enqueuePodDeletion(obj interface{}) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			runtime.HandleError(fmt.Errorf("Unexpected object in pod deletion %#v", obj))
+			return
+		}
+		pod, ok = tombstone.Obj.(*v1.Pod)
+		if !ok {
+			runtime.HandleError(fmt.Errorf("Tombstone contained an object that is not a pod %#v", tombstone.Obj))
+			return
+		}
+	}
+	c.sampler.untrack(podKey(pod))
+	c.enqueueTermination(podTermination(pod))
+}
+
+// enqueueTermination queues an end of life record while the controller runs.
+// Terminations missed before that are found by reconcile.
+func (c *PodController) enqueueTermination(termination *model.Termination) {
+	if c.running.Load() {
+		c.podqueue.Add(termination)
+	}
+}
+
+// podFinished reports whether all containers of the pod terminated for good
+func podFinished(pod *v1.Pod) bool {
+	return pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed
+}
+
+// podTermination builds the end of life record of a pod from its last known state
+func podTermination(pod *v1.Pod) *model.Termination {
+	return &model.Termination{
+		ObjectRef: model.ObjectRef{
+			Kind:      model.KindPod,
+			UID:       string(pod.UID),
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+		Timestamp:  podEndTime(pod),
+		FinalState: string(pod.Status.Phase),
+	}
+}
+
+// podEndTime returns when the last container of a finished pod terminated,
+// or the current time for a pod that is being removed while still running.
+func podEndTime(pod *v1.Pod) time.Time {
+	if !podFinished(pod) {
+		return time.Now()
+	}
+
+	var end time.Time
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Terminated != nil && status.State.Terminated.FinishedAt.After(end) {
+			end = status.State.Terminated.FinishedAt.Time
+		}
+	}
+	if end.IsZero() {
+		return time.Now()
+	}
+	return end
 }
 
-func (c *PodController) Run(workers int) error {
+func (c *PodController) Run(ctx context.Context, workers int) error {
 
 	defer runtime.HandleCrash()
 
@@ -68,28 +185,32 @@ func (c *PodController) Run(workers int) error {
 	// Wait for the caches to be synced before starting workers
 	signals.Logger.Info("Waiting for informer caches to sync")
 
-	if ok := cache.WaitForCacheSync(signals.Ctx.Done(), c.podsSynced); !ok {
+	if ok := cache.WaitForCacheSync(ctx.Done(), append(c.owners.synced(), c.podsSynced)...); !ok {
 		return fmt.Errorf("Failed to wait for caches to sync")
 	}
 
+	c.running.Store(true)
+	defer c.running.Store(false)
+
+	c.reconcile()
+
+	signals.Logger.Info("Sampling pods", "interval", c.sampler.interval, "jitter", c.sampler.jitter)
+	go c.sampler.run(ctx)
+	go c.transforms.Run(ctx, time.Second*time.Duration(env.EnvironmentVariables.TransformReload))
+
 	signals.Logger.Info("Starting workers for pods", "count", workers)
-	for range workers {
-		go wait.UntilWithContext(signals.Ctx, c.runWorker, time.Second)
-	}
+	runWorkers(ctx, c.podqueue, workers, c.runWorker)
+	signals.Logger.Info("Stopped workers for pods")
 
 	return nil
 }
 
 func (c *PodController) runWorker(ctx context.Context) {
-	for c.processNextWorkItem(
-		ctx,
-		transform.NewTransform(
-			signals.Ctx,
-			env.EnvironmentVariables.TransformPath+c.baseTransformPath())) {
+	for ctx.Err() == nil && c.processNextWorkItem(ctx, c.transforms.Current()) {
 	}
 }
 
-func (c *PodController) processNextWorkItem(ctx context.Context, transform *transform.Transform) bool {
+func (c *PodController) processNextWorkItem(ctx context.Context, current *transform.Transform) bool {
 	obj, shutdown := c.podqueue.Get()
 
 	if shutdown {
@@ -98,6 +219,21 @@ func (c *PodController) processNextWorkItem(ctx context.Context, transform *tran
 	// We wrap this block in a func so we can defer c.workqueue.Done.
 	err := func(obj interface{}) error {
 		defer c.podqueue.Done(obj)
+		// End of life records are queued as they are, since the pod
+		// is no longer in the informer cache.
+		if termination, ok := obj.(*model.Termination); ok {
+			start := time.Now()
+			err := persistence.GetPersistInterface().RecordTermination(termination)
+			observeWrite(c.FriendlyName(), "terminate", start, err)
+			if err != nil {
+				retryOnTransient(c.podqueue, obj, err)
+				runtime.HandleError(fmt.Errorf("Cannot record termination of pod %s/%s: %w", termination.Namespace, termination.Name, err))
+				return nil
+			}
+			c.podqueue.Forget(obj)
+			return nil
+		}
+
 		var key string
 		var ok bool
 		// We expect strings to come off the workqueue. These are of the
@@ -127,7 +263,19 @@ func (c *PodController) processNextWorkItem(ctx context.Context, transform *tran
 		}
 
 		if pod.Status.Phase == v1.PodRunning {
-			transformedPodJson, err := transform.Transform(ctx, pod)
+			now := time.Now()
+			source := &podSource{
+				Pod:            pod,
+				Controller:     c.owners.resolve(pod),
+				SampleInterval: c.sampler.elapsed(key, now).Seconds(),
+			}
+			transformedPodJson, err := current.Transform(ctx, c.cycle, source)
+			if errors.Is(err, transform.ErrNoUsage) {
+				// Sampled on the next cycle, once the usage source knows the pod
+				signals.Logger.V(2).Info("Skipping pod without usage", "key", key, "reason", err.Error())
+				c.podqueue.Forget(obj)
+				return nil
+			}
 			if err != nil {
 				c.podqueue.AddRateLimited(obj)
 				runtime.HandleError(fmt.Errorf("Cannot transform pod JSON for key %s:", key))
@@ -135,13 +283,16 @@ func (c *PodController) processNextWorkItem(ctx context.Context, transform *tran
 			}
 			signals.Logger.Info("About to register", "pod data", string(transformedPodJson))
 
+			start := time.Now()
 			err = persistence.GetPersistInterface().InsertPodJson(string(transformedPodJson))
+			observeWrite(c.FriendlyName(), "insert", start, err)
 
 			if err != nil {
-				c.podqueue.AddRateLimited(obj)
-				runtime.HandleError(fmt.Errorf("Cannot insert pod JSON: %s", string(transformedPodJson)))
+				retryOnTransient(c.podqueue, obj, err)
+				runtime.HandleError(fmt.Errorf("Cannot insert pod JSON %s: %w", string(transformedPodJson), err))
 				return nil
 			}
+			c.sampler.sampled(key, now)
 		}
 
 		c.podqueue.Forget(obj)
@@ -157,6 +308,43 @@ func (c *PodController) processNextWorkItem(ctx context.Context, transform *tran
 	return true
 }
 
+// reconcile closes out the pods that are still alive in the persistence
+// layer but vanished from the cluster while the monitor was not running.
+func (c *PodController) reconcile() {
+	active, err := persistence.GetPersistInterface().ListActive(model.KindPod)
+	if err != nil {
+		signals.Logger.Error(err, "Unable to list active pods for reconciliation")
+		return
+	}
+
+	pods, err := c.podsLister.List(labels.Everything())
+	if err != nil {
+		signals.Logger.Error(err, "Unable to list pods from informer cache for reconciliation")
+		return
+	}
+
+	known := make(map[string]*v1.Pod, len(pods))
+	for _, pod := range pods {
+		known[string(pod.UID)] = pod
+	}
+
+	for _, object := range active {
+		if pod, exists := known[object.UID]; exists {
+			if podFinished(pod) {
+				c.podqueue.Add(podTermination(pod))
+			}
+			continue
+		}
+		c.podqueue.Add(&model.Termination{
+			ObjectRef:  object.ObjectRef,
+			Timestamp:  lastSeen(object),
+			FinalState: string(v1.PodUnknown),
+		})
+	}
+
+	signals.Logger.Info("Reconciled pods", "active", len(active), "cached", len(pods))
+}
+
 // Returns the friendly name of the controller
 func (c *PodController) FriendlyName() string {
 	return "PodController"
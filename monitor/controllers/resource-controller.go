@@ -0,0 +1,331 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	transform "klustercost/monitor/controllers/templates"
+	"klustercost/monitor/pkg/env"
+	"klustercost/monitor/pkg/health"
+	"klustercost/monitor/pkg/model"
+	"klustercost/monitor/pkg/persistence"
+	"klustercost/monitor/pkg/signals"
+	"sync/atomic"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+// ResourceConfig describes a kind observed by a ResourceController
+type ResourceConfig struct {
+	// Kind recorded with the terminations and the active objects, e.g. Service
+	Kind string
+	// Informer of the kind. It must be registered before the factory is started.
+	Informer cache.SharedIndexInformer
+	// Key returns the workqueue key of an object. It must match the keys of the
+	// informer index; cache.MetaNamespaceKeyFunc is used when nil.
+	Key cache.KeyFunc
+	// Directory of the transform, relative to the transform path, e.g. /services/
+	TransformPath string
+	// Persist stores the transformed JSON of an object
+	Persist func(object_json string) error
+	// Terminate builds the end of life record of a deleted object.
+	// When nil, the record carries the object reference only.
+	Terminate func(obj interface{}) *model.Termination
+	// Sample, when set, records the objects it accepts once per sampling
+	// interval, like the pods, instead of on every change of the informer
+	Sample func(obj interface{}) bool
+	// Source builds the object handed to the transform from the cached object
+	// and the time since its previous sample. The object is used as it is when nil.
+	Source func(obj interface{}, elapsed time.Duration) interface{}
+	// Synced are the further informers Source reads, waited for along with Informer
+	Synced []cache.InformerSynced
+}
+
+// ResourceController records every object of a kind through its transform
+// whenever the informer reports a change, or on the cycles of its sampler,
+// and its termination once it is deleted. Informer events are ignored while
+// it is not running, e.g. on a standby replica.
+type ResourceController struct {
+	config     ResourceConfig
+	queue      workqueue.RateLimitingInterface
+	sampler    *sampler
+	cycle      *transform.Cycle
+	synced     []cache.InformerSynced
+	transforms *transform.TransformWatcher
+	running    atomic.Bool
+}
+
+func NewResourceController(config ResourceConfig) *ResourceController {
+	if config.Key == nil {
+		config.Key = cache.MetaNamespaceKeyFunc
+	}
+	if config.Terminate == nil {
+		config.Terminate = func(obj interface{}) *model.Termination {
+			return objectTermination(config.Kind, obj)
+		}
+	}
+
+	rc := &ResourceController{
+		config: config,
+		queue:  workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), config.Kind),
+		synced: append([]cache.InformerSynced{config.Informer.HasSynced}, config.Synced...)}
+	if config.Sample != nil {
+		// Cluster queries are evaluated again on every cycle of this sampler
+		rc.cycle = transform.NewCycle()
+		rc.sampler = newSampler(
+			time.Second*time.Duration(env.EnvironmentVariables.SampleInterval),
+			env.EnvironmentVariables.SampleJitter,
+			func(key string) { rc.queue.Add(key) },
+			rc.cycle.Start)
+	}
+
+	var err error
+	rc.transforms, err = transform.NewTransformWatcher(
+		signals.Ctx,
+		env.EnvironmentVariables.TransformPath+config.TransformPath)
+	if err != nil {
+		signals.Logger.Error(err, "Klustercost: invalid transform", "kind", config.Kind)
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+
+	_, err = config.Informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: rc.enqueue,
+		UpdateFunc: func(old, new interface{}) {
+			rc.enqueue(new)
+		},
+		DeleteFunc: rc.enqueueDeletion,
+	})
+	if err != nil {
+		signals.Logger.Error(err, "Klustercost:  unable to watch", "kind", config.Kind)
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+	health.AddReadinessCheck(rc.FriendlyName(), cacheSynced(rc.synced...))
+
+	return rc
+}
+
+// enqueue records a changed object, or keeps the sampling inventory up to date
+// when the sampler decides when objects are recorded
+func (rc *ResourceController) enqueue(obj interface{}) {
+	if rc.sampler == nil && !rc.running.Load() {
+		return
+	}
+	key, err := rc.config.Key(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	if rc.sampler == nil {
+		rc.queue.Add(key)
+	} else if rc.config.Sample(obj) {
+		rc.sampler.track(key)
+	} else {
+		rc.sampler.untrack(key)
+	}
+}
+
+// enqueueDeletion queues the end of life record of a deleted object,
+// unwrapping the tombstone handed over when the watch missed the deletion.
+func (rc *ResourceController) enqueueDeletion(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if rc.sampler != nil {
+		if key, err := rc.config.Key(obj); err == nil {
+			rc.sampler.untrack(key)
+		}
+	}
+	if !rc.running.Load() {
+		return
+	}
+	if termination := rc.config.Terminate(obj); termination != nil {
+		rc.queue.Add(termination)
+	}
+}
+
+// objectTermination builds the end of life record of any object from its metadata
+func objectTermination(kind string, obj interface{}) *model.Termination {
+	object, err := meta.Accessor(obj)
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("unexpected object in %s deletion %#v", kind, obj))
+		return nil
+	}
+
+	return &model.Termination{
+		ObjectRef: model.ObjectRef{
+			Kind:      kind,
+			UID:       string(object.GetUID()),
+			Name:      object.GetName(),
+			Namespace: object.GetNamespace(),
+		},
+		Timestamp: time.Now(),
+	}
+}
+
+func (rc *ResourceController) Run(ctx context.Context, workers int) error {
+
+	defer runtime.HandleCrash()
+
+	signals.Logger.Info("Klustercost: Starting observer threads", "kind", rc.config.Kind)
+
+	// Wait for the caches to be synced before starting workers
+	signals.Logger.Info("Waiting for informer caches to sync", "kind", rc.config.Kind)
+
+	if ok := cache.WaitForCacheSync(ctx.Done(), rc.synced...); !ok {
+		return fmt.Errorf("failed to wait for %s caches to sync", rc.config.Kind)
+	}
+
+	rc.running.Store(true)
+	defer rc.running.Store(false)
+	if rc.sampler == nil {
+		// Events were ignored until now, so record everything the cache holds
+		for _, key := range rc.config.Informer.GetStore().ListKeys() {
+			rc.queue.Add(key)
+		}
+	}
+
+	rc.reconcile()
+
+	if rc.sampler != nil {
+		signals.Logger.Info("Sampling objects", "kind", rc.config.Kind, "interval", rc.sampler.interval, "jitter", rc.sampler.jitter)
+		go rc.sampler.run(ctx)
+	}
+
+	go rc.transforms.Run(ctx, time.Second*time.Duration(env.EnvironmentVariables.TransformReload))
+
+	signals.Logger.Info("Starting workers", "kind", rc.config.Kind, "count", workers)
+	runWorkers(ctx, rc.queue, workers, rc.runWorker)
+	signals.Logger.Info("Stopped workers", "kind", rc.config.Kind)
+
+	return nil
+}
+
+// runWorker runs a worker to process items from the workqueue
+func (rc *ResourceController) runWorker(ctx context.Context) {
+	for ctx.Err() == nil && rc.processNextWorkItem(ctx, rc.transforms.Current()) {
+	}
+}
+
+// processNextWorkItem processes items from the workqueue
+func (rc *ResourceController) processNextWorkItem(ctx context.Context, transform *transform.Transform) bool {
+	obj, shutdown := rc.queue.Get()
+
+	if shutdown {
+		return false
+	}
+	defer rc.queue.Done(obj)
+
+	// End of life records are queued as they are, since the object
+	// is no longer in the informer cache.
+	if termination, ok := obj.(*model.Termination); ok {
+		start := time.Now()
+		err := persistence.GetPersistInterface().RecordTermination(termination)
+		observeWrite(rc.FriendlyName(), "terminate", start, err)
+		if err != nil {
+			retryOnTransient(rc.queue, obj, err)
+			runtime.HandleError(fmt.Errorf("cannot record termination of %s %s: %w", rc.config.Kind, termination.Name, err))
+			return true
+		}
+		rc.queue.Forget(obj)
+		return true
+	}
+
+	key, ok := obj.(string)
+	if !ok {
+		// Invalid items would loop forever, drop them
+		rc.queue.Forget(obj)
+		runtime.HandleError(fmt.Errorf("expected string in workqueue but got %#v", obj))
+		return true
+	}
+
+	object, exists, err := rc.config.Informer.GetIndexer().GetByKey(key)
+	if err != nil || !exists || (rc.sampler != nil && !rc.config.Sample(object)) {
+		// Deleted since it was queued, its termination is queued too,
+		// or no longer sampled
+		rc.queue.Forget(obj)
+		return true
+	}
+
+	now := time.Now()
+	source := object
+	if rc.config.Source != nil {
+		var elapsed time.Duration
+		if rc.sampler != nil {
+			elapsed = rc.sampler.elapsed(key, now)
+		}
+		source = rc.config.Source(object, elapsed)
+	}
+
+	transformedJson, err := transform.Transform(ctx, rc.cycle, source)
+	if err != nil {
+		rc.queue.AddRateLimited(obj)
+		runtime.HandleError(fmt.Errorf("cannot transform %s JSON for key %s: %w", rc.config.Kind, key, err))
+		return true
+	}
+
+	start := time.Now()
+	err = rc.config.Persist(string(transformedJson))
+	observeWrite(rc.FriendlyName(), "insert", start, err)
+	if err != nil {
+		retryOnTransient(rc.queue, obj, err)
+		runtime.HandleError(fmt.Errorf("cannot insert %s %s: %w", rc.config.Kind, key, err))
+		return true
+	}
+	if rc.sampler != nil {
+		rc.sampler.sampled(key, now)
+	}
+
+	rc.queue.Forget(obj)
+	return true
+}
+
+// reconcile closes out the objects that are still alive in the persistence
+// layer but vanished from the cluster while the monitor was not running.
+func (rc *ResourceController) reconcile() {
+	active, err := persistence.GetPersistInterface().ListActive(rc.config.Kind)
+	if err != nil {
+		signals.Logger.Error(err, "Unable to list active objects for reconciliation", "kind", rc.config.Kind)
+		return
+	}
+
+	for _, object := range active {
+		key := cache.ObjectName{Namespace: object.Namespace, Name: object.Name}.String()
+		if cached, exists, _ := rc.config.Informer.GetIndexer().GetByKey(key); exists && sameObject(cached, object.ObjectRef) {
+			continue
+		}
+		rc.queue.Add(&model.Termination{
+			ObjectRef:  object.ObjectRef,
+			Timestamp:  lastSeen(object),
+			FinalState: string(v1.ConditionUnknown),
+		})
+	}
+
+	signals.Logger.Info("Reconciled objects", "kind", rc.config.Kind, "active", len(active))
+}
+
+// lastSeen is when a vanished object was known to exist for the last time,
+// the end of life it is closed with. Objects the backend has no sample time
+// of end now.
+func lastSeen(object model.ActiveObject) time.Time {
+	if object.LastSeen.IsZero() {
+		return time.Now()
+	}
+	return object.LastSeen
+}
+
+// sameObject tells whether the cached object is the recorded one and not
+// another one created under the same name since
+func sameObject(obj interface{}, ref model.ObjectRef) bool {
+	object, err := meta.Accessor(obj)
+	return err != nil || ref.UID == "" || string(object.GetUID()) == ref.UID
+}
+
+// Returns the friendly name of the controller
+func (rc *ResourceController) FriendlyName() string {
+	return rc.config.Kind + "Controller"
+}
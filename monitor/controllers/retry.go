@@ -0,0 +1,17 @@
+package controller
+
+import (
+	"klustercost/monitor/pkg/persistence"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+// retryOnTransient requeues obj with rate limiting when the persistence
+// failure may go away, and forgets it when retrying cannot help.
+func retryOnTransient(queue workqueue.RateLimitingInterface, obj interface{}, err error) {
+	if persistence.IsTransient(err) {
+		queue.AddRateLimited(obj)
+		return
+	}
+	queue.Forget(obj)
+}
@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"klustercost/monitor/pkg/signals"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// sampler owns the inventory of objects worth sampling and enqueues all of
+// them once per interval, so the sample density does not depend on how
+// often the informer reports changes. The interval is stretched by up to
+// jitter (a fraction of the interval) so that replicas and restarts do not
+// line up their cycles.
+type sampler struct {
+	interval time.Duration
+	jitter   float64
+	enqueue  func(key string)
+	onCycle  func()
+
+	lock    sync.Mutex
+	tracked map[string]time.Time
+}
+
+// onCycle, when set, is called at the start of every cycle before anything is enqueued
+func newSampler(interval time.Duration, jitter float64, enqueue func(key string), onCycle func()) *sampler {
+	return &sampler{
+		interval: interval,
+		jitter:   jitter,
+		enqueue:  enqueue,
+		onCycle:  onCycle,
+		tracked:  make(map[string]time.Time),
+	}
+}
+
+// track adds the key to the inventory, keeping its sampling history
+func (s *sampler) track(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, exists := s.tracked[key]; !exists {
+		s.tracked[key] = time.Time{}
+	}
+}
+
+// untrack removes the key from the inventory
+func (s *sampler) untrack(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.tracked, key)
+}
+
+// elapsed returns the time between the previous sample of the key and now,
+// or zero when the key has not been sampled yet.
+func (s *sampler) elapsed(key string, now time.Time) time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	last := s.tracked[key]
+	if last.IsZero() {
+		return 0
+	}
+	return now.Sub(last)
+}
+
+// sampled records that a sample of the key taken at now was stored
+func (s *sampler) sampled(key string, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, exists := s.tracked[key]; exists {
+		s.tracked[key] = now
+	}
+}
+
+// run enqueues the whole inventory every interval until ctx is done
+func (s *sampler) run(ctx context.Context) {
+	wait.JitterUntilWithContext(ctx, s.cycle, s.interval, s.jitter, true)
+}
+
+func (s *sampler) cycle(ctx context.Context) {
+	s.lock.Lock()
+	keys := make([]string, 0, len(s.tracked))
+	for key := range s.tracked {
+		keys = append(keys, key)
+	}
+	s.lock.Unlock()
+
+	signals.Logger.V(2).Info("Starting sampling cycle", "count", len(keys))
+	if s.onCycle != nil {
+		s.onCycle()
+	}
+	for _, key := range keys {
+		s.enqueue(key)
+	}
+}
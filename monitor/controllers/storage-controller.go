@@ -0,0 +1,201 @@
+package controller
+
+import (
+	"fmt"
+	"klustercost/monitor/pkg/model"
+	"klustercost/monitor/pkg/persistence"
+	"klustercost/monitor/pkg/signals"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// Index of the pod informer holding the namespace/name keys of the claims a pod mounts
+const claimIndex = "claim"
+
+// volumeSources builds the sources of the /volume/ transform from the
+// informer caches of the objects related to a claim
+type volumeSources struct {
+	volumesLister corelisters.PersistentVolumeLister
+	classesLister storagelisters.StorageClassLister
+	pods          cache.Indexer
+	owners        *ownerResolver
+}
+
+// volumeSource is the object handed to the /volume/ transform: the claim
+// itself plus its volume, its StorageClass and the running pods mounting it.
+type volumeSource struct {
+	*v1.PersistentVolumeClaim
+	Volume       *v1.PersistentVolume    `json:"volume,omitempty"`
+	StorageClass *storagev1.StorageClass `json:"storageClass,omitempty"`
+	Pods         []volumePod             `json:"pods,omitempty"`
+	// Workload charged for the volume: the one of the first mounting pod,
+	// or the controller of the claim when no pod mounts it
+	Controller *model.Controller `json:"controller,omitempty"`
+	// Seconds since the previous sample of the claim, absent for its first sample
+	SampleInterval float64 `json:"sampleInterval,omitempty"`
+}
+
+// volumePod is a running pod mounting the claim
+type volumePod struct {
+	Name       string            `json:"name"`
+	UID        string            `json:"uid"`
+	Node       string            `json:"node,omitempty"`
+	Controller *model.Controller `json:"controller,omitempty"`
+}
+
+// NewStorageController samples the bound PersistentVolumeClaims, like the pod
+// controller samples the running pods, so the cost of their volumes can be
+// charged to the namespace and the workload that mount them.
+func NewStorageController(informer informers.SharedInformerFactory) *ResourceController {
+	claimInformer := informer.Core().V1().PersistentVolumeClaims()
+	volumeInformer := informer.Core().V1().PersistentVolumes()
+	classInformer := informer.Storage().V1().StorageClasses()
+	podInformer := informer.Core().V1().Pods()
+
+	err := podInformer.Informer().AddIndexers(cache.Indexers{claimIndex: podClaims})
+	if err != nil {
+		signals.Logger.Error(err, "Klustercost: unable to index pods by claim")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+
+	sources := &volumeSources{
+		volumesLister: volumeInformer.Lister(),
+		classesLister: classInformer.Lister(),
+		pods:          podInformer.Informer().GetIndexer(),
+		owners:        newOwnerResolver(informer)}
+
+	return NewResourceController(ResourceConfig{
+		Kind:          model.KindVolume,
+		Informer:      claimInformer.Informer(),
+		TransformPath: "/volume/",
+		Persist: func(object_json string) error {
+			return persistence.GetPersistInterface().InsertVolumeJson(object_json)
+		},
+		Terminate: func(obj interface{}) *model.Termination {
+			claim, ok := obj.(*v1.PersistentVolumeClaim)
+			if !ok {
+				runtime.HandleError(fmt.Errorf("Unexpected object in persistent volume claim deletion %#v", obj))
+				return nil
+			}
+			return claimTermination(claim, time.Now())
+		},
+		Sample: func(obj interface{}) bool {
+			return obj.(*v1.PersistentVolumeClaim).Status.Phase == v1.ClaimBound
+		},
+		Source: func(obj interface{}, elapsed time.Duration) interface{} {
+			return sources.volumeSource(obj.(*v1.PersistentVolumeClaim), elapsed)
+		},
+		Synced: append(sources.owners.synced(),
+			volumeInformer.Informer().HasSynced,
+			classInformer.Informer().HasSynced,
+			podInformer.Informer().HasSynced),
+	})
+}
+
+// podClaims indexes a pod by the claims of its volumes, including the
+// claims created for its generic ephemeral volumes
+func podClaims(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return nil, nil
+	}
+	var keys []string
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim != nil {
+			keys = append(keys, pod.Namespace+"/"+volume.PersistentVolumeClaim.ClaimName)
+		} else if volume.Ephemeral != nil {
+			keys = append(keys, pod.Namespace+"/"+pod.Name+"-"+volume.Name)
+		}
+	}
+	return keys, nil
+}
+
+func claimKey(claim *v1.PersistentVolumeClaim) string {
+	return claim.Namespace + "/" + claim.Name
+}
+
+// claimTermination builds the end of life record of a claim from its last known phase
+func claimTermination(claim *v1.PersistentVolumeClaim, timestamp time.Time) *model.Termination {
+	return &model.Termination{
+		ObjectRef: model.ObjectRef{
+			Kind:      model.KindVolume,
+			UID:       string(claim.UID),
+			Name:      claim.Name,
+			Namespace: claim.Namespace,
+		},
+		Timestamp:  timestamp,
+		FinalState: string(claim.Status.Phase),
+	}
+}
+
+// volumeSource gathers the volume, the StorageClass and the mounting pods
+// of the claim from the informer caches. Those not found are left out.
+func (c *volumeSources) volumeSource(claim *v1.PersistentVolumeClaim, elapsed time.Duration) *volumeSource {
+	source := &volumeSource{
+		PersistentVolumeClaim: claim,
+		SampleInterval:        elapsed.Seconds(),
+	}
+
+	if claim.Spec.VolumeName != "" {
+		if volume, err := c.volumesLister.Get(claim.Spec.VolumeName); err == nil {
+			source.Volume = volume
+		}
+	}
+
+	// The class of the bound volume wins, it is the one the claim got
+	className := ""
+	if claim.Spec.StorageClassName != nil {
+		className = *claim.Spec.StorageClassName
+	}
+	if source.Volume != nil && source.Volume.Spec.StorageClassName != "" {
+		className = source.Volume.Spec.StorageClassName
+	}
+	if className != "" {
+		if class, err := c.classesLister.Get(className); err == nil {
+			source.StorageClass = class
+		}
+	}
+
+	source.Pods = c.mountingPods(claimKey(claim))
+	if len(source.Pods) > 0 {
+		source.Controller = source.Pods[0].Controller
+	} else if ref := metav1.GetControllerOf(claim); ref != nil {
+		source.Controller = &model.Controller{Kind: ref.Kind, Name: ref.Name, UID: string(ref.UID)}
+	}
+	return source
+}
+
+// mountingPods returns the running pods mounting the claim, by name
+func (c *volumeSources) mountingPods(key string) []volumePod {
+	objs, err := c.pods.ByIndex(claimIndex, key)
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("Unable to look up the pods of claim %s: %w", key, err))
+		return nil
+	}
+
+	var pods []volumePod
+	for _, obj := range objs {
+		pod := obj.(*v1.Pod)
+		if pod.Status.Phase != v1.PodRunning {
+			continue
+		}
+		pods = append(pods, volumePod{
+			Name:       pod.Name,
+			UID:        string(pod.UID),
+			Node:       pod.Spec.NodeName,
+			Controller: c.owners.resolve(pod),
+		})
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	return pods
+}
@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	apis "klustercost/monitor/controllers/apis"
+	model "klustercost/monitor/pkg/model"
+	signals "klustercost/monitor/pkg/signals"
+
+	prometheusmodel "github.com/prometheus/common/model"
+)
+
+// Query modes of the metrics transforms, selected by METRICS_QUERY_MODE
+const (
+	// Every metrics transform runs its query once per pod
+	QueryModePod = "pod"
+	// Metrics transforms with a clusterQuery run it once per sampling cycle
+	// and answer every pod from the result
+	QueryModeCluster = "cluster"
+)
+
+// Cycle scopes the results of the cluster queries and the lists of the usage
+// sources to the sampling cycles of one sampler: within a cycle, every lookup
+// is answered from a single evaluation. Samplers each own a Cycle, so their
+// cycles neither repeat nor cut short the evaluations of the others.
+type Cycle struct {
+	current atomic.Uint64
+
+	lock    sync.Mutex
+	indexes map[string]*clusterIndex
+	sources map[string]*usageSource
+}
+
+func NewCycle() *Cycle {
+	return &Cycle{
+		indexes: make(map[string]*clusterIndex),
+		sources: make(map[string]*usageSource),
+	}
+}
+
+// Start marks the beginning of a sampling cycle, so the next lookup of every
+// cluster query and usage source evaluates it again.
+func (c *Cycle) Start() {
+	c.current.Add(1)
+}
+
+type podRef struct {
+	namespace string
+	name      string
+}
+
+// clusterIndex holds the result of one cluster-wide vector query, by pod
+type clusterIndex struct {
+	lock      sync.Mutex
+	cycle     uint64
+	built     bool
+	timestamp prometheusmodel.Time
+	values    map[podRef]prometheusmodel.SampleValue
+	err       error
+}
+
+func (c *Cycle) clusterIndex(query string) *clusterIndex {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	index, exists := c.indexes[query]
+	if !exists {
+		index = &clusterIndex{}
+		c.indexes[query] = index
+	}
+	return index
+}
+
+// lookupCluster answers a pod from the cluster query, evaluating the query at
+// most once per cycle. The answer has the shape of the scalar() the per pod
+// query returns, so the same transform handles both modes.
+func lookupCluster(ctx context.Context, cycle *Cycle, query string, from model.DataExchange) ([]byte, error) {
+	namespace, name := from["namespace"], from["name"]
+	if namespace == nil || name == nil {
+		return nil, fmt.Errorf("Unable to look up cluster query %s without namespace and name", query)
+	}
+
+	index := cycle.clusterIndex(query)
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	if current := cycle.current.Load(); !index.built || index.cycle != current {
+		index.refresh(ctx, query)
+		index.cycle = current
+		index.built = true
+	}
+	if index.err != nil {
+		return nil, index.err
+	}
+
+	value, exists := index.values[podRef{fmt.Sprintf("%v", namespace), fmt.Sprintf("%v", name)}]
+	if !exists {
+		value = prometheusmodel.SampleValue(math.NaN())
+	}
+	return json.Marshal(&prometheusmodel.Scalar{Value: value, Timestamp: index.timestamp})
+}
+
+// refresh evaluates the vector query and indexes its samples by namespace and pod
+func (c *clusterIndex) refresh(ctx context.Context, query string) {
+	now := time.Now()
+	result, err := apis.Query(ctx, query, now)
+	observeQuery(QueryModeCluster, now, err)
+	if err != nil {
+		signals.Logger.Error(err, "Unable to query API for cluster metrics", "query", query)
+		c.err = err
+		return
+	}
+
+	vector, ok := result.(prometheusmodel.Vector)
+	if !ok {
+		c.err = fmt.Errorf("Cluster query %s returned %s instead of a vector", query, result.Type())
+		return
+	}
+
+	c.values = make(map[podRef]prometheusmodel.SampleValue, len(vector))
+	for _, sample := range vector {
+		ref := podRef{string(sample.Metric["namespace"]), string(sample.Metric["pod"])}
+		c.values[ref] = sample.Value
+	}
+	c.timestamp = prometheusmodel.TimeFromUnixNano(now.UnixNano())
+	c.err = nil
+	signals.Logger.V(2).Info("Evaluated cluster query", "query", query, "pods", len(c.values), "duration", time.Since(now))
+}
@@ -0,0 +1,33 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	transformFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "klustercost_transform_failures_total",
+		Help: "Number of objects a transform failed on, by transform directory and entry: labels, or the index of the metrics.json entry.",
+	}, []string{"path", "entry"})
+
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "klustercost_prometheus_query_duration_seconds",
+		Help:    "Latency of the queries of the metrics transforms, by query mode or usage source and outcome.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"mode", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(transformFailures, queryDuration)
+}
+
+// observeQuery records how long a Prometheus query or the fetch of a usage source took
+func observeQuery(mode string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	queryDuration.WithLabelValues(mode, result).Observe(time.Since(start).Seconds())
+}
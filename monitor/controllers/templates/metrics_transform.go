@@ -3,11 +3,14 @@ package controller
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	apis "klustercost/monitor/controllers/apis"
+	"klustercost/monitor/pkg/env"
 	"os"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,14 +19,20 @@ import (
 	signals "klustercost/monitor/pkg/signals"
 
 	jsonata "github.com/blues/jsonata-go"
-	prometheusv1 "github.com/prometheus/client_golang/api/prometheus/v1"
 )
 
 var re *regexp.Regexp = regexp.MustCompile(`\$(.+?)\$`)
 
 type metricsTransform struct {
-	Query             string `json:"query"`
-	Transform         string `json:"transform"`
+	Query string `json:"query"`
+	// Optional vector query grouped by namespace and pod, used instead of
+	// Query when METRICS_QUERY_MODE is cluster
+	ClusterQuery string `json:"clusterQuery"`
+	// Where the transform input comes from: prometheus, the default, metrics-server or kubelet
+	Source    string `json:"source"`
+	Transform string `json:"transform"`
+	// Position in metrics.json, reported with the failures
+	entry             string
 	expansionKeys     []string
 	jsonataExpression *jsonata.Expr
 }
@@ -41,6 +50,7 @@ func NewMetricsTransformsFromFile(path string) ([]metricsTransform, error) {
 	}
 
 	for idx := range transforms {
+		transforms[idx].entry = strconv.Itoa(idx)
 		err := transforms[idx].Compile()
 		if err != nil {
 			return nil, err
@@ -66,6 +76,9 @@ func (c *metricsTransform) compileTransform() error {
 }
 
 func (c *metricsTransform) Compile() error {
+	if _, exists := usageSources[c.Source]; c.Source != "" && c.Source != SourcePrometheus && !exists {
+		return fmt.Errorf("Unknown source %s of metrics transform %s", c.Source, c.Transform)
+	}
 	c.computeKeySet()
 	return c.compileTransform()
 }
@@ -83,11 +96,9 @@ func (c *metricsTransform) queryWithContext(from model.DataExchange) (string, er
 }
 
 func (c *metricsTransform) callAPI(ctx context.Context, query string) ([]byte, error) {
-	metric, _, err := apis.GetPrometheusAPI().Query(
-		ctx,
-		query,
-		time.Now(),
-		prometheusv1.WithTimeout(5*time.Second))
+	start := time.Now()
+	metric, err := apis.Query(ctx, query, start)
+	observeQuery(QueryModePod, start, err)
 	if err != nil {
 		signals.Logger.Error(err, "Unable to query API for metrics transformation")
 		return nil, err
@@ -101,9 +112,34 @@ func (c *metricsTransform) callAPI(ctx context.Context, query string) ([]byte, e
 	return metricJSON, nil
 }
 
-func (c *metricsTransform) AddMetrics(ctx context.Context, transformedObject model.DataExchange, sourceObject []byte) (model.DataExchange, error) {
+// AddMetrics evaluates the entry for the object. Cluster queries and usage
+// sources are evaluated once per cycle; without a cycle, cluster queries
+// give way to the per pod query.
+func (c *metricsTransform) AddMetrics(ctx context.Context, cycle *Cycle, transformedObject model.DataExchange, sourceObject []byte) (model.DataExchange, error) {
 	metricJSON := sourceObject
 
+	if c.Source != "" && c.Source != SourcePrometheus {
+		metricJSON, err := lookupSource(ctx, cycle, c.Source, transformedObject)
+		if errors.Is(err, ErrNoUsage) {
+			return transformedObject, err
+		}
+		if err != nil {
+			signals.Logger.Error(err, "Unable to look up source for metrics transformation", "source", c.Source)
+			return transformedObject, err
+		}
+		return c.evaluate(transformedObject, metricJSON)
+	}
+
+	if c.ClusterQuery != "" && env.EnvironmentVariables.MetricsQueryMode == QueryModeCluster && cycle != nil {
+		var err error
+		metricJSON, err = lookupCluster(ctx, cycle, c.ClusterQuery, transformedObject)
+		if err != nil {
+			signals.Logger.Error(err, "Unable to look up cluster query for metrics transformation")
+			return transformedObject, err
+		}
+		return c.evaluate(transformedObject, metricJSON)
+	}
+
 	expandedQuery, err := c.queryWithContext(transformedObject)
 	if err != nil {
 		signals.Logger.Error(err, "Unable to generate query for metrics transformation")
@@ -118,7 +154,12 @@ func (c *metricsTransform) AddMetrics(ctx context.Context, transformedObject mod
 		}
 	}
 
-	metricJSON, err = c.jsonataExpression.EvalBytes(metricJSON)
+	return c.evaluate(transformedObject, metricJSON)
+}
+
+// evaluate runs the transform on the metric and merges its keys into the transformed object
+func (c *metricsTransform) evaluate(transformedObject model.DataExchange, metricJSON []byte) (model.DataExchange, error) {
+	metricJSON, err := c.jsonataExpression.EvalBytes(metricJSON)
 	if err != nil {
 		signals.Logger.Error(err, "Unable to evaluate template")
 		return transformedObject, err
@@ -3,6 +3,8 @@ package controller
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 
 	jsonata "github.com/blues/jsonata-go"
@@ -13,32 +15,33 @@ import (
 
 type Transform struct {
 	logger            klog.Logger
+	path              string
 	labelsTransform   *jsonata.Expr
 	metricsTransforms []metricsTransform
 }
 
-func NewTransform(ctx context.Context, path string) *Transform {
+// NewTransform compiles the labels.jsonata and metrics.json files found in path
+func NewTransform(ctx context.Context, path string) (*Transform, error) {
 	logger := klog.FromContext(ctx)
 
 	var metricsTransforms []metricsTransform
 
 	metricsTransforms, err := NewMetricsTransformsFromFile(path + "metrics.json")
 	if err != nil {
-		logger.Error(err, "Unable to read metrics transforms")
-		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		return nil, fmt.Errorf("Unable to read metrics transforms: %w", err)
 	}
 
 	transform, err := getTransform(path + "labels.jsonata")
 	if err != nil {
-		logger.Error(err, "Unable to read template transform")
-		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		return nil, fmt.Errorf("Unable to read template transform: %w", err)
 	}
 
 	return &Transform{
 		logger:            logger,
+		path:              path,
 		labelsTransform:   transform,
 		metricsTransforms: metricsTransforms,
-	}
+	}, nil
 }
 
 func getTransform(path string) (*jsonata.Expr, error) {
@@ -54,10 +57,13 @@ func getTransform(path string) (*jsonata.Expr, error) {
 	return expression, nil
 }
 
-func (c *Transform) addMetrics(ctx context.Context, keyValues model.DataExchange, sourceJSON []byte) (model.DataExchange, error) {
+func (c *Transform) addMetrics(ctx context.Context, cycle *Cycle, keyValues model.DataExchange, sourceJSON []byte) (model.DataExchange, error) {
 	for _, transform := range c.metricsTransforms {
-		keyValues, err := transform.AddMetrics(ctx, keyValues, sourceJSON)
+		keyValues, err := transform.AddMetrics(ctx, cycle, keyValues, sourceJSON)
 		if err != nil {
+			if !errors.Is(err, ErrNoUsage) {
+				transformFailures.WithLabelValues(c.path, transform.entry).Inc()
+			}
 			return keyValues, err
 		}
 	}
@@ -68,6 +74,7 @@ func (c *Transform) getTransformedObject(sourceJSON []byte) (model.DataExchange,
 	var transformedObject model.DataExchange
 	transformedJSON, err := c.labelsTransform.EvalBytes(sourceJSON)
 	if err != nil {
+		transformFailures.WithLabelValues(c.path, "labels").Inc()
 		c.logger.Error(err, "Unable to evaluate template")
 		return nil, err
 	}
@@ -79,7 +86,10 @@ func (c *Transform) getTransformedObject(sourceJSON []byte) (model.DataExchange,
 	return transformedObject, nil
 }
 
-func (c *Transform) Transform(ctx context.Context, source any) ([]byte, error) {
+// Transform shapes the source object and adds the metrics of the metrics
+// transforms, sharing their cluster queries and usage sources within the
+// cycle of the caller's sampler. Callers without a sampler pass a nil cycle.
+func (c *Transform) Transform(ctx context.Context, cycle *Cycle, source any) ([]byte, error) {
 	sourceJSON, err := json.Marshal(source)
 	if err != nil {
 		c.logger.Error(err, "Unable to marshal source to JSON")
@@ -90,7 +100,10 @@ func (c *Transform) Transform(ctx context.Context, source any) ([]byte, error) {
 		c.logger.Error(err, "Unable to get transformed object")
 		return nil, err
 	}
-	transformedObject, err = c.addMetrics(ctx, transformedObject, sourceJSON)
+	transformedObject, err = c.addMetrics(ctx, cycle, transformedObject, sourceJSON)
+	if errors.Is(err, ErrNoUsage) {
+		return nil, err
+	}
 	if err != nil {
 		c.logger.Error(err, "Unable to add metrics to object")
 		return nil, err
@@ -0,0 +1,234 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	apis "klustercost/monitor/controllers/apis"
+	model "klustercost/monitor/pkg/model"
+	signals "klustercost/monitor/pkg/signals"
+
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Sources of the metrics transforms, selected by the source key of a metrics.json entry
+const (
+	// The query of the entry runs against Prometheus, the default
+	SourcePrometheus = "prometheus"
+	// The entry transforms the PodMetrics of the pod from metrics.k8s.io
+	SourceMetricsServer = "metrics-server"
+	// The entry transforms the pod of the stats summary of its kubelet
+	SourceKubelet = "kubelet"
+)
+
+// ErrNoUsage is returned for a pod its usage source has no sample of, e.g.
+// because the pod started after the last scrape. The pod is skipped for the
+// sampling cycle rather than recorded without usage.
+var ErrNoUsage = errors.New("no usage sample of the pod yet")
+
+// Kubelets read at the same time when listing the kubelet source
+const kubeletParallelism = 8
+
+// Upper bound of fetching metrics-server for a sampling cycle
+const sourceTimeout = 30 * time.Second
+
+// Upper bound of reading the stats summary of one kubelet, so a slow node
+// does not use up the time of the others
+const kubeletTimeout = 10 * time.Second
+
+// usageSource lists the usage of all the pods once per cycle and answers
+// every pod from that list
+type usageSource struct {
+	name    string
+	timeout time.Duration
+	fetch   func(ctx context.Context) (map[podRef]json.RawMessage, error)
+
+	lock  sync.Mutex
+	cycle uint64
+	built bool
+	pods  map[podRef]json.RawMessage
+	err   error
+}
+
+var usageSources = map[string]*usageSource{
+	SourceMetricsServer: {name: SourceMetricsServer, timeout: sourceTimeout, fetch: fetchPodMetrics},
+	SourceKubelet:       {name: SourceKubelet, fetch: fetchKubeletSummaries},
+}
+
+// usageSource returns the list of the source for the cycle
+func (c *Cycle) usageSource(name string) *usageSource {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	source, exists := c.sources[name]
+	if !exists {
+		source = &usageSource{name: name, timeout: usageSources[name].timeout, fetch: usageSources[name].fetch}
+		c.sources[name] = source
+	}
+	return source
+}
+
+// The nodes whose kubelets are read by the kubelet source
+var nodeLister corelisters.NodeLister
+
+// SetNodeLister hands the nodes tracked by the node controller to the kubelet source
+func SetNodeLister(lister corelisters.NodeLister) {
+	nodeLister = lister
+}
+
+// lookupSource answers a pod from the usage source, listing it at most once
+// per cycle, or for every pod without a cycle. Pods the source does not know
+// yet get ErrNoUsage.
+func lookupSource(ctx context.Context, cycle *Cycle, name string, from model.DataExchange) ([]byte, error) {
+	namespace, podName := from["namespace"], from["name"]
+	if namespace == nil || podName == nil {
+		return nil, fmt.Errorf("Unable to look up source %s without namespace and name", name)
+	}
+
+	var source *usageSource
+	if cycle == nil {
+		source = &usageSource{name: name, timeout: usageSources[name].timeout, fetch: usageSources[name].fetch}
+		source.refresh(ctx)
+	} else {
+		source = cycle.usageSource(name)
+		source.lock.Lock()
+		defer source.lock.Unlock()
+
+		if current := cycle.current.Load(); !source.built || source.cycle != current {
+			source.refresh(ctx)
+			source.cycle = current
+			source.built = true
+		}
+	}
+	if source.err != nil {
+		return nil, source.err
+	}
+
+	if pod, exists := source.pods[podRef{fmt.Sprintf("%v", namespace), fmt.Sprintf("%v", podName)}]; exists {
+		return pod, nil
+	}
+	return nil, fmt.Errorf("source %s, pod %v/%v: %w", name, namespace, podName, ErrNoUsage)
+}
+
+func (s *usageSource) refresh(ctx context.Context) {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	s.pods, s.err = s.fetch(ctx)
+	observeQuery(s.name, start, s.err)
+	if s.err != nil {
+		signals.Logger.Error(s.err, "Unable to fetch usage source", "source", s.name)
+		return
+	}
+	signals.Logger.V(2).Info("Fetched usage source", "source", s.name, "pods", len(s.pods), "duration", time.Since(start))
+}
+
+// fetchPodMetrics indexes the PodMetrics of metrics-server by pod
+func fetchPodMetrics(ctx context.Context) (map[podRef]json.RawMessage, error) {
+	data, err := apis.PodMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var list struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("Unable to decode the PodMetrics list: %w", err)
+	}
+
+	pods := make(map[podRef]json.RawMessage, len(list.Items))
+	for _, item := range list.Items {
+		var metrics struct {
+			Metadata struct {
+				Namespace string `json:"namespace"`
+				Name      string `json:"name"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(item, &metrics); err != nil {
+			return nil, fmt.Errorf("Unable to decode PodMetrics: %w", err)
+		}
+		pods[podRef{metrics.Metadata.Namespace, metrics.Metadata.Name}] = item
+	}
+	return pods, nil
+}
+
+// fetchKubeletSummaries indexes the pods of the stats summaries of all the
+// kubelets by pod. Every kubelet has kubeletTimeout to answer; the pods of
+// the nodes whose kubelet does not are left out and get ErrNoUsage. The
+// source only fails when no kubelet answers.
+func fetchKubeletSummaries(ctx context.Context) (map[podRef]json.RawMessage, error) {
+	if nodeLister == nil {
+		return nil, fmt.Errorf("no nodes for the kubelet source")
+	}
+	nodes, err := nodeLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		lock   sync.Mutex
+		pods   = make(map[podRef]json.RawMessage)
+		failed int
+	)
+	workqueue.ParallelizeUntil(ctx, kubeletParallelism, len(nodes), func(idx int) {
+		node := nodes[idx].Name
+		nodeCtx, cancel := context.WithTimeout(ctx, kubeletTimeout)
+		defer cancel()
+		summary, err := kubeletSummary(nodeCtx, node)
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			failed++
+			signals.Logger.Error(err, "Unable to read the kubelet stats summary", "node", node)
+			return
+		}
+		for ref, pod := range summary {
+			pods[ref] = pod
+		}
+	})
+
+	if len(nodes) > 0 && failed == len(nodes) {
+		return nil, fmt.Errorf("no kubelet answered out of %d nodes", len(nodes))
+	}
+	return pods, nil
+}
+
+// kubeletSummary reads the stats summary of a node and indexes its pods
+func kubeletSummary(ctx context.Context, node string) (map[podRef]json.RawMessage, error) {
+	data, err := apis.KubeletSummary(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+
+	var summary struct {
+		Pods []json.RawMessage `json:"pods"`
+	}
+	if err := json.Unmarshal(data, &summary); err != nil {
+		return nil, fmt.Errorf("Unable to decode the stats summary: %w", err)
+	}
+
+	pods := make(map[podRef]json.RawMessage, len(summary.Pods))
+	for _, pod := range summary.Pods {
+		var stats struct {
+			PodRef struct {
+				Namespace string `json:"namespace"`
+				Name      string `json:"name"`
+			} `json:"podRef"`
+		}
+		if err := json.Unmarshal(pod, &stats); err != nil {
+			return nil, fmt.Errorf("Unable to decode pod stats: %w", err)
+		}
+		pods[podRef{stats.PodRef.Namespace, stats.PodRef.Name}] = pod
+	}
+	return pods, nil
+}
@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"sync/atomic"
+	"time"
+
+	signals "klustercost/monitor/pkg/signals"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Files of a transform directory, watched for changes
+var transformFiles = []string{"labels.jsonata", "metrics.json"}
+
+var transformReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "klustercost_transform_reloads_total",
+	Help: "Number of times a transform directory changed, by outcome of the recompilation.",
+}, []string{"path", "result"})
+
+func init() {
+	prometheus.MustRegister(transformReloads)
+}
+
+// TransformWatcher keeps the Transform of a directory up to date. It polls the
+// files for content changes, which also catches the symlink swap used by
+// ConfigMap volumes, and recompiles them. Workers pick up the new Transform
+// on their next item; when the new files do not compile, the last good
+// Transform stays in use.
+type TransformWatcher struct {
+	path     string
+	current  atomic.Pointer[Transform]
+	checksum [sha256.Size]byte
+}
+
+// NewTransformWatcher compiles the transform directory once. It fails when
+// the initial files are invalid, as there is no previous version to fall back to.
+func NewTransformWatcher(ctx context.Context, path string) (*TransformWatcher, error) {
+	w := &TransformWatcher{path: path}
+
+	checksum, err := w.contentChecksum()
+	if err != nil {
+		return nil, err
+	}
+	transform, err := NewTransform(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	w.checksum = checksum
+	w.current.Store(transform)
+	return w, nil
+}
+
+// Current returns the latest Transform that compiled
+func (w *TransformWatcher) Current() *Transform {
+	return w.current.Load()
+}
+
+// Run checks the directory for changes every interval until ctx is done
+func (w *TransformWatcher) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, w.reload, interval)
+}
+
+func (w *TransformWatcher) reload(ctx context.Context) {
+	checksum, err := w.contentChecksum()
+	if err != nil {
+		signals.Logger.Error(err, "Unable to read transform directory, keeping the current transform", "path", w.path)
+		return
+	}
+	if checksum == w.checksum {
+		return
+	}
+	w.checksum = checksum
+
+	transform, err := NewTransform(ctx, w.path)
+	if err != nil {
+		transformReloads.WithLabelValues(w.path, "failure").Inc()
+		signals.Logger.Error(err, "Transform changed but does not compile, keeping the last good transform", "path", w.path)
+		return
+	}
+
+	w.current.Store(transform)
+	transformReloads.WithLabelValues(w.path, "success").Inc()
+	signals.Logger.Info("Transform reloaded", "path", w.path)
+}
+
+// contentChecksum hashes the content of the transform files
+func (w *TransformWatcher) contentChecksum() ([sha256.Size]byte, error) {
+	hash := sha256.New()
+	for _, name := range transformFiles {
+		data, err := os.ReadFile(w.path + name)
+		if err != nil {
+			return [sha256.Size]byte{}, err
+		}
+		hash.Write(data)
+		hash.Write([]byte{0})
+	}
+	return [sha256.Size]byte(hash.Sum(nil)), nil
+}
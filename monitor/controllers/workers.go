@@ -0,0 +1,28 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// runWorkers runs the workers until ctx is done, then shuts the queue down
+// and waits for the items being processed. Items still queued are dropped,
+// as the process stops or another replica takes over.
+func runWorkers(ctx context.Context, queue workqueue.RateLimitingInterface, workers int, worker func(context.Context)) {
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait.UntilWithContext(ctx, worker, time.Second)
+		}()
+	}
+
+	<-ctx.Done()
+	queue.ShutDown()
+	wg.Wait()
+}
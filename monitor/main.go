@@ -1,50 +1,103 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"klustercost/monitor/pkg/env"
+	"klustercost/monitor/pkg/health"
 	"klustercost/monitor/pkg/observer"
 	"klustercost/monitor/pkg/persistence"
 	"klustercost/monitor/pkg/signals"
 	"klustercost/monitor/pkg/version"
 
 	controller "klustercost/monitor/controllers"
+	apis "klustercost/monitor/controllers/apis"
 
 	_ "github.com/lib/pq"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
 	"k8s.io/klog/v2"
 )
 
 var controllers []observer.Controller
 
-func get_config() (*rest.Config, error) {
+func get_config(kubeconfig string) (*rest.Config, error) {
 	config, err := rest.InClusterConfig()
 	if nil == err {
 		return config, err
 	}
 
-	dirname, err := os.UserHomeDir()
-	if err != nil {
-		return nil, err
+	if kubeconfig == "" {
+		dirname, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		kubeconfig = filepath.Join(dirname, ".kube", "config")
 	}
-
-	kubeconfig := flag.String("kubeconfig", dirname+"\\.kube\\config", "kubeconfig file")
-	flag.Parse()
-	return clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	return clientcmd.BuildConfigFromFlags("", kubeconfig)
 }
 
 func main() {
+	kubeconfig := flag.String("kubeconfig", "", "kubeconfig file, used outside of a cluster (default ~/.kube/config)")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration, secrets redacted, and exit")
+
+	configuration, err := env.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		signals.Logger.Error(err, "Invalid configuration")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 2)
+	}
+	env.EnvironmentVariables = configuration
+
+	if *printConfig {
+		if err := configuration.Print(os.Stdout); err != nil {
+			signals.Logger.Error(err, "Cannot print the configuration")
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+		return
+	}
+
 	signals.Logger.Info("Klustercost [Observer]", "v", version.Version)
 
 	defer persistence.Close()
 
-	config, err := get_config()
+	go health.Serve(signals.Ctx, env.EnvironmentVariables.HttpAddress)
+	// The backends are opened in the background, the database may take a
+	// while to come up and migrate; the monitor is not ready until then
+	go persistence.GetPersistInterface()
+	health.AddReadinessCheck("persistence", func() error {
+		if !persistence.Ready() {
+			return errors.New("persistence not initialized")
+		}
+		return persistence.GetPersistInterface().Ping()
+	})
+	// Without a Prometheus server the transforms rely on the other usage sources
+	if env.EnvironmentVariables.PrometheusServer != "" {
+		if err := apis.NewPrometheusAPI(env.EnvironmentVariables); err != nil {
+			signals.Logger.Error(err, "Unable to create Prometheus client")
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+		health.AddReadinessCheck("prometheus", func() error {
+			ctx, cancel := context.WithTimeout(signals.Ctx, 5*time.Second)
+			defer cancel()
+			return apis.PingPrometheus(ctx)
+		})
+	}
+
+	config, err := get_config(*kubeconfig)
 	if err != nil {
 		signals.Logger.Error(err, "Cannot get a valid k8s context")
 		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
@@ -55,23 +108,139 @@ func main() {
 		signals.Logger.Error(err, "Error building kubernetes clientset")
 		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
+	apis.SetKubernetesClient(kubeClient)
 	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, time.Second*time.Duration(env.EnvironmentVariables.ResyncTime))
 
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		signals.Logger.Error(err, "Error building dynamic kubernetes client")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+	dynamicInformerFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, time.Second*time.Duration(env.EnvironmentVariables.ResyncTime))
+
 	// Create the controllers
-	// All new controllers to be initialized from here
+	// Further kinds are observed through OBSERVED_KINDS rather than new controllers
 	controllers = append(controllers,
 		controller.NewPodController(kubeClient, kubeInformerFactory),
-		controller.NewNodeController(kubeClient, kubeInformerFactory),
+		controller.NewNodeController(kubeInformerFactory),
 	)
 
+	if env.EnvironmentVariables.StorageCost {
+		controllers = append(controllers, controller.NewStorageController(kubeInformerFactory))
+	}
+
+	observed, err := controller.NewObservedControllers(env.EnvironmentVariables.ObservedKinds, kubeInformerFactory)
+	if err != nil {
+		signals.Logger.Error(err, "Invalid list of observed kinds")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+	controllers = append(controllers, observed...)
+
+	resources, err := controller.ParseResources(env.EnvironmentVariables.ObservedResources)
+	if err != nil {
+		signals.Logger.Error(err, "Invalid list of observed resources")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+	controllers = append(controllers, controller.NewDynamicControllers(resources, kubeClient.Discovery(), dynamicInformerFactory)...)
+
+	// Informers run on every replica, so a standby takes over with warm caches
 	kubeInformerFactory.Start(signals.Ctx.Done())
+	dynamicInformerFactory.Start(signals.Ctx.Done())
 
-	for _, controller := range controllers {
-		if err = controller.Run(env.EnvironmentVariables.ControllerWorkers); err != nil {
-			signals.Logger.Error(err, "Error running ", controller.FriendlyName())
-			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	if !env.EnvironmentVariables.LeaderElect {
+		runControllers(signals.Ctx)
+		return
+	}
+	runWithLeaderElection(kubeClient)
+}
+
+// runControllers runs all the controllers until ctx is done and their workers stopped
+func runControllers(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, c := range controllers {
+		wg.Add(1)
+		go func(c observer.Controller) {
+			defer wg.Done()
+			if err := c.Run(ctx, env.EnvironmentVariables.ControllerWorkers); err != nil {
+				signals.Logger.Error(err, "Error running ", c.FriendlyName())
+				klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+			}
+		}(c)
+	}
+	wg.Wait()
+}
+
+// runWithLeaderElection runs the controllers only while this replica holds the
+// lease. On shutdown the lease is released once the workers stopped, so the
+// next leader does not write alongside this one. A replica that loses the lease
+// stops its workers, flushes the persistence and exits.
+func runWithLeaderElection(kubeClient kubernetes.Interface) {
+	identity, err := os.Hostname()
+	if err != nil {
+		signals.Logger.Error(err, "Cannot determine the leader election identity")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      env.EnvironmentVariables.LeaderElectionID,
+			Namespace: env.EnvironmentVariables.LeaderElectionNs,
+		},
+		Client:     kubeClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	// Outlives signals.Ctx until the workers stopped, releasing the lease last
+	electionCtx, cancelElection := context.WithCancel(context.Background())
+	defer cancelElection()
+
+	var leading atomic.Bool
+	stopped := make(chan struct{})
+	go func() {
+		<-signals.Ctx.Done()
+		if !leading.Load() {
+			cancelElection()
 		}
+	}()
+
+	leaderelection.RunOrDie(electionCtx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		Name:            env.EnvironmentVariables.LeaderElectionID,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				leading.Store(true)
+				defer close(stopped)
+				defer cancelElection()
+				signals.Logger.Info("Started leading, running controllers", "identity", identity)
+
+				ctx, cancel := context.WithCancel(ctx)
+				defer cancel()
+				defer context.AfterFunc(signals.Ctx, cancel)()
+				runControllers(ctx)
+			},
+			OnStoppedLeading: func() {
+				signals.Logger.Info("Stopped leading", "identity", identity)
+			},
+			OnNewLeader: func(current string) {
+				if current != identity {
+					signals.Logger.Info("Following the leader", "leader", current)
+				}
+			},
+		},
+	})
+
+	if !leading.Load() {
+		return
 	}
+	<-stopped
 
-	<-signals.Ctx.Done()
+	if signals.Ctx.Err() == nil {
+		signals.Logger.Info("Lost the leader lease, exiting")
+		persistence.Close()
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
 }
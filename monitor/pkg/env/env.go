@@ -1,122 +1,305 @@
 package env
 
 import (
-	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
 
-	"k8s.io/klog/v2"
+	"gopkg.in/yaml.v3"
 )
 
-// EnvVars is a struct that holds the env variables
+// EnvVars is the configuration of the monitor. Every setting is read, in
+// increasing order of precedence, from its default, the YAML file given by
+// --config or CONFIG_FILE, its environment variable and its command-line flag.
 type EnvVars struct {
-	ResyncTime        int
-	ControllerWorkers int
-	PgDbUser          string
-	PgDbPass          string
-	PgDbName          string
-	PgDbHost          string
-	PgDbPort          string
-	PrometheusServer  string
-	TransformPath     string
+	ResyncTime        int     `yaml:"resyncTime" env:"RESYNC_TIME" flag:"resync-time" usage:"Seconds between full resyncs of the informers"`
+	ControllerWorkers int     `yaml:"controllerWorkers" env:"CONTROLLER_WORKERS" flag:"controller-workers" usage:"Workers per controller"`
+	PgDbUser          string  `yaml:"pgDbUser" env:"PG_DB_USER" flag:"pg-db-user" usage:"PostgreSQL user"`
+	PgDbPass          string  `yaml:"pgDbPass" env:"PG_DB_PASS" flag:"pg-db-pass" usage:"PostgreSQL password" secret:"true"`
+	PgDbName          string  `yaml:"pgDbName" env:"PG_DB_NAME" flag:"pg-db-name" usage:"PostgreSQL database"`
+	PgDbHost          string  `yaml:"pgDbHost" env:"PG_DB_HOST" flag:"pg-db-host" usage:"PostgreSQL host"`
+	PgDbPort          int     `yaml:"pgDbPort" env:"PG_DB_PORT" flag:"pg-db-port" usage:"PostgreSQL port"`
+	PgDbPassFile      string  `yaml:"pgDbPassFile" env:"PG_DB_PASS_FILE" flag:"pg-db-pass-file" usage:"File holding the PostgreSQL password, read on every new connection; overrides pgDbPass"`
+	PgSslMode         string  `yaml:"pgSslMode" env:"PG_SSL_MODE" flag:"pg-ssl-mode" usage:"PostgreSQL sslmode: disable, allow, prefer, require, verify-ca or verify-full"`
+	PgSslRootCert     string  `yaml:"pgSslRootCert" env:"PG_SSL_ROOT_CERT" flag:"pg-ssl-root-cert" usage:"CA certificate file verifying the PostgreSQL server"`
+	PgSslCert         string  `yaml:"pgSslCert" env:"PG_SSL_CERT" flag:"pg-ssl-cert" usage:"Client certificate file presented to PostgreSQL"`
+	PgSslKey          string  `yaml:"pgSslKey" env:"PG_SSL_KEY" flag:"pg-ssl-key" usage:"Private key file of the client certificate"`
+	PgConnMaxLifetime int     `yaml:"pgConnMaxLifetime" env:"PG_CONN_MAX_LIFETIME" flag:"pg-conn-max-lifetime" usage:"Seconds after which a PostgreSQL connection is reopened with the current credentials"`
+	PrometheusServer  string  `yaml:"prometheusServer" env:"PROMETHEUS_SERVER" flag:"prometheus-server" usage:"URL of the Prometheus server queried by the metrics transforms, empty when no transform queries Prometheus"`
+	PromToken         string  `yaml:"prometheusBearerToken" env:"PROMETHEUS_BEARER_TOKEN" flag:"prometheus-bearer-token" usage:"Bearer token sent to Prometheus" secret:"true"`
+	PromTokenFile     string  `yaml:"prometheusBearerTokenFile" env:"PROMETHEUS_BEARER_TOKEN_FILE" flag:"prometheus-bearer-token-file" usage:"File holding the bearer token sent to Prometheus, read on every query"`
+	PromUsername      string  `yaml:"prometheusUsername" env:"PROMETHEUS_USERNAME" flag:"prometheus-username" usage:"Basic auth user of Prometheus"`
+	PromPassword      string  `yaml:"prometheusPassword" env:"PROMETHEUS_PASSWORD" flag:"prometheus-password" usage:"Basic auth password of Prometheus" secret:"true"`
+	PromPasswordFile  string  `yaml:"prometheusPasswordFile" env:"PROMETHEUS_PASSWORD_FILE" flag:"prometheus-password-file" usage:"File holding the basic auth password of Prometheus, read on every query"`
+	PromHeaders       string  `yaml:"prometheusHeaders" env:"PROMETHEUS_HEADERS" flag:"prometheus-headers" usage:"Comma separated list of Name=value headers sent to Prometheus, e.g. X-Scope-OrgID=team-a" secret:"true"`
+	PromCAFile        string  `yaml:"prometheusCaFile" env:"PROMETHEUS_CA_FILE" flag:"prometheus-ca-file" usage:"CA bundle verifying the Prometheus server"`
+	PromCertFile      string  `yaml:"prometheusCertFile" env:"PROMETHEUS_CERT_FILE" flag:"prometheus-cert-file" usage:"Client certificate file presented to Prometheus"`
+	PromKeyFile       string  `yaml:"prometheusKeyFile" env:"PROMETHEUS_KEY_FILE" flag:"prometheus-key-file" usage:"Private key file of the Prometheus client certificate"`
+	PromInsecure      bool    `yaml:"prometheusInsecureSkipVerify" env:"PROMETHEUS_INSECURE_SKIP_VERIFY" flag:"prometheus-insecure-skip-verify" usage:"Do not verify the certificate of the Prometheus server"`
+	PromTimeout       int     `yaml:"prometheusTimeout" env:"PROMETHEUS_TIMEOUT" flag:"prometheus-timeout" usage:"Seconds a single Prometheus query may take"`
+	TransformPath     string  `yaml:"transformPath" env:"TRANSFORM_PATH" flag:"transform-path" usage:"Directory holding one transform directory per kind"`
+	ExporterAddress   string  `yaml:"exporterAddress" env:"EXPORTER_ADDRESS" flag:"exporter-address" usage:"Listen address of the prometheus persistence"`
+	Persistence       string  `yaml:"persistence" env:"PERSISTENCE" flag:"persistence" usage:"Comma separated list of persistence backends: postgres, prometheus"`
+	PgBatchSize       int     `yaml:"pgBatchSize" env:"PG_BATCH_SIZE" flag:"pg-batch-size" usage:"Pod samples written to PostgreSQL per batch, 1 disables batching"`
+	PgFlushInterval   int     `yaml:"pgFlushInterval" env:"PG_FLUSH_INTERVAL" flag:"pg-flush-interval" usage:"Maximum seconds a pod sample waits for its batch"`
+	SampleInterval    int     `yaml:"sampleInterval" env:"SAMPLE_INTERVAL" flag:"sample-interval" usage:"Seconds between two samples of a running pod"`
+	SampleJitter      float64 `yaml:"sampleJitter" env:"SAMPLE_JITTER" flag:"sample-jitter" usage:"Random stretch of the sample interval, as a fraction of it"`
+	MetricsQueryMode  string  `yaml:"metricsQueryMode" env:"METRICS_QUERY_MODE" flag:"metrics-query-mode" usage:"pod or cluster"`
+	TransformReload   int     `yaml:"transformReload" env:"TRANSFORM_RELOAD" flag:"transform-reload" usage:"Seconds between checks of the transform files for changes"`
+	ObservedKinds     string  `yaml:"observedKinds" env:"OBSERVED_KINDS" flag:"observed-kinds" usage:"Comma separated list of further kinds to record, e.g. namespaces,services"`
+	ObservedResources string  `yaml:"observedResources" env:"OBSERVED_RESOURCES" flag:"observed-resources" usage:"Comma separated list of group/version/resource to record"`
+	LeaderElect       bool    `yaml:"leaderElect" env:"LEADER_ELECT" flag:"leader-elect" usage:"Only sample and write while holding the leader lease"`
+	LeaderElectionNs  string  `yaml:"leaderElectionNamespace" env:"LEADER_ELECTION_NAMESPACE" flag:"leader-election-namespace" usage:"Namespace of the leader lease"`
+	LeaderElectionID  string  `yaml:"leaderElectionId" env:"LEADER_ELECTION_ID" flag:"leader-election-id" usage:"Name of the leader lease"`
+	ExtendedResources string  `yaml:"extendedResources" env:"EXTENDED_RESOURCES" flag:"extended-resources" usage:"Comma separated list of extended resources recorded for nodes and pods; those named */gpu count as GPUs"`
+	StorageCost       bool    `yaml:"storageCost" env:"STORAGE_COST" flag:"storage-cost" usage:"Sample the bound PersistentVolumeClaims and charge their volumes to the workloads mounting them"`
+	HttpAddress       string  `yaml:"httpAddress" env:"HTTP_ADDRESS" flag:"http-address" usage:"Listen address of the health checks and self metrics"`
 }
 
-var EnvironmentVariables *EnvVars
+// EnvironmentVariables is the configuration in use. It holds the defaults
+// until Load replaces it at startup.
+var EnvironmentVariables = Defaults()
 
-func init() {
-	EnvironmentVariables = NewConfiguration()
+// Defaults returns the configuration used when nothing overrides a setting
+func Defaults() *EnvVars {
+	return &EnvVars{
+		ResyncTime:        600,
+		ControllerWorkers: 2,
+		PgDbUser:          "postgres",
+		PgDbPass:          "admin",
+		PgDbName:          "klustercost",
+		PgDbHost:          "localhost",
+		PgDbPort:          5432,
+		PgSslMode:         "disable",
+		PgConnMaxLifetime: 1800,
+		PrometheusServer:  "http://127.0.0.1:8080",
+		PromTimeout:       30,
+		TransformPath:     "./transform",
+		ExporterAddress:   ":9095",
+		Persistence:       "postgres",
+		PgBatchSize:       500,
+		PgFlushInterval:   5,
+		SampleInterval:    300,
+		SampleJitter:      0.1,
+		MetricsQueryMode:  "pod",
+		TransformReload:   30,
+		LeaderElectionNs:  "default",
+		LeaderElectionID:  "klustercost-monitor",
+		ExtendedResources: "nvidia.com/gpu,amd.com/gpu",
+		HttpAddress:       ":8081",
+	}
 }
 
-// InitEnvVars reads the env file and sets the env variables
-// If the env file is not found, it uses the default values
-func NewConfiguration() *EnvVars {
-	//Open the env file and read the values
-	file, err := os.Open("../config/env")
-	logger := klog.Background()
+// Load registers a flag for every setting on flags, parses args and builds
+// the configuration from the defaults, the YAML file, the environment and
+// the flags. It fails on unknown keys in the file, on values that do not
+// parse and on values out of range; nothing falls back silently.
+func Load(flags *flag.FlagSet, args []string) (*EnvVars, error) {
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file (CONFIG_FILE)")
+	settingFlags := make(map[string]*settingFlag)
+	forEachSetting(func(field reflect.StructField) {
+		value := &settingFlag{field: field.Name, isBool: field.Type.Kind() == reflect.Bool}
+		settingFlags[field.Tag.Get("flag")] = value
+		flags.Var(value, field.Tag.Get("flag"), fmt.Sprintf("%s (%s)", field.Tag.Get("usage"), field.Tag.Get("env")))
+	})
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
 
-	if err != nil {
-		logger.Info("No env file found, using default values")
-	}
-	defer file.Close()
-
-	//Read the file line by line and set the env variables
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) == 2 {
-			key := strings.TrimSpace(parts[0])
-			value := strings.TrimSpace(parts[1])
-			os.Setenv(key, value)
+	result := Defaults()
+	if *configFile != "" {
+		if err := result.loadFile(*configFile); err != nil {
+			return nil, err
 		}
 	}
 
-	//Default values for the env variables
-	result := &EnvVars{600, 2, "postgres", "admin", "klustercost", "localhost", "5432", "http://127.0.0.1:8080", "./transform"}
-
-	resync_time, err := strconv.Atoi(os.Getenv("RESYNC_TIME"))
-	if err == nil {
-		result.ResyncTime = resync_time
-	} else {
-		logger.Info("RESYNC_TIME not set, using default value of 600s")
+	var errs []error
+	settings := reflect.ValueOf(result).Elem()
+	forEachSetting(func(field reflect.StructField) {
+		name := field.Tag.Get("env")
+		// A variable set to the empty string overrides too, e.g. to clear a server
+		if value, set := os.LookupEnv(name); set {
+			if err := setValue(settings.FieldByName(field.Name), value); err != nil {
+				errs = append(errs, fmt.Errorf("environment variable %s: %w", name, err))
+			}
+		}
+	})
+	flags.Visit(func(f *flag.Flag) {
+		if value, exists := settingFlags[f.Name]; exists {
+			if err := setValue(settings.FieldByName(value.field), value.text); err != nil {
+				errs = append(errs, fmt.Errorf("flag --%s: %w", f.Name, err))
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
 	}
 
-	controller_workers, err := strconv.Atoi(os.Getenv("CONTROLLER_WORKERS"))
-	if err == nil {
-		result.ControllerWorkers = controller_workers
-	} else {
-		logger.Info("CONTROLLER_WORKERS not set, using default value of 2")
+	if err := result.Validate(); err != nil {
+		return nil, err
 	}
+	return result, nil
+}
 
-	pg_db_user := os.Getenv("PG_DB_USER")
-	if pg_db_user != "" {
-		result.PgDbUser = pg_db_user
-	} else {
-		logger.Info("PG_DB_USER not set, using default value")
-	}
+// settingFlag keeps the text of a flag, parsed once the file and the environment are applied
+type settingFlag struct {
+	field  string
+	text   string
+	isBool bool
+}
 
-	pg_db_pass := os.Getenv("PG_DB_PASS")
-	if pg_db_pass != "" {
-		result.PgDbPass = pg_db_pass
-	} else {
-		logger.Info("PG_DB_PASS not set, using default value")
-	}
+func (f *settingFlag) String() string     { return f.text }
+func (f *settingFlag) Set(s string) error { f.text = s; return nil }
+func (f *settingFlag) IsBoolFlag() bool   { return f.isBool }
 
-	pg_db_name := os.Getenv("PG_DB_NAME")
-	if pg_db_name != "" {
-		result.PgDbName = pg_db_name
-	} else {
-		logger.Info("PG_DB_NAME not set, using default value")
+// loadFile overrides the settings present in the YAML file
+func (c *EnvVars) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
 	}
-
-	pg_db_port := os.Getenv("PG_DB_PORT")
-	if pg_db_port != "" {
-		result.PgDbPort = pg_db_port
-	} else {
-		logger.Info("PG_DB_PORT not set, using default value 5432")
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("configuration file %s: %w", path, err)
 	}
+	return nil
+}
 
-	pg_db_host := os.Getenv("PG_DB_HOST")
-	if pg_db_host != "" {
-		result.PgDbHost = pg_db_host
-	} else {
-		logger.Info("PG_DB_HOST not set, using default value 127.0.0.1")
+// Validate checks the ranges and the enumerations of the settings
+func (c *EnvVars) Validate() error {
+	var errs []error
+	positive := []struct {
+		name  string
+		value int
+	}{
+		{"resyncTime", c.ResyncTime},
+		{"controllerWorkers", c.ControllerWorkers},
+		{"pgBatchSize", c.PgBatchSize},
+		{"pgFlushInterval", c.PgFlushInterval},
+		{"pgConnMaxLifetime", c.PgConnMaxLifetime},
+		{"sampleInterval", c.SampleInterval},
+		{"transformReload", c.TransformReload},
+		{"prometheusTimeout", c.PromTimeout},
+	}
+	for _, setting := range positive {
+		if setting.value < 1 {
+			errs = append(errs, fmt.Errorf("%s must be at least 1, got %d", setting.name, setting.value))
+		}
+	}
+	if c.PgDbPort < 1 || c.PgDbPort > 65535 {
+		errs = append(errs, fmt.Errorf("pgDbPort must be a port number, got %d", c.PgDbPort))
+	}
+	switch c.PgSslMode {
+	case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		errs = append(errs, fmt.Errorf("pgSslMode must be disable, allow, prefer, require, verify-ca or verify-full, got %q", c.PgSslMode))
+	}
+	if (c.PgSslCert == "") != (c.PgSslKey == "") {
+		errs = append(errs, fmt.Errorf("pgSslCert and pgSslKey must be set together"))
+	}
+	if c.PromToken != "" && c.PromTokenFile != "" {
+		errs = append(errs, fmt.Errorf("prometheusBearerToken and prometheusBearerTokenFile are mutually exclusive"))
+	}
+	if c.PromPassword != "" && c.PromPasswordFile != "" {
+		errs = append(errs, fmt.Errorf("prometheusPassword and prometheusPasswordFile are mutually exclusive"))
 	}
+	if c.PromUsername != "" && (c.PromToken != "" || c.PromTokenFile != "") {
+		errs = append(errs, fmt.Errorf("prometheus basic auth and bearer token are mutually exclusive"))
+	}
+	if (c.PromCertFile == "") != (c.PromKeyFile == "") {
+		errs = append(errs, fmt.Errorf("prometheusCertFile and prometheusKeyFile must be set together"))
+	}
+	if _, err := c.PrometheusHeaders(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.SampleJitter < 0 || c.SampleJitter > 1 {
+		errs = append(errs, fmt.Errorf("sampleJitter must be between 0 and 1, got %v", c.SampleJitter))
+	}
+	if c.MetricsQueryMode != "pod" && c.MetricsQueryMode != "cluster" {
+		errs = append(errs, fmt.Errorf("metricsQueryMode must be pod or cluster, got %q", c.MetricsQueryMode))
+	}
+	if strings.TrimSpace(c.Persistence) == "" {
+		errs = append(errs, fmt.Errorf("persistence must name at least one backend"))
+	}
+	if c.LeaderElect && (c.LeaderElectionNs == "" || c.LeaderElectionID == "") {
+		errs = append(errs, fmt.Errorf("leaderElectionNamespace and leaderElectionId are required with leaderElect"))
+	}
+	return errors.Join(errs...)
+}
 
-	prometheus_server := os.Getenv("PROMETHEUS_SERVER")
-	if prometheus_server != "" {
-		result.PrometheusServer = prometheus_server
-	} else {
-		logger.Info("PROMETHEUS_SERVER not set, using default value http://127.0.0.1:8080")
+// PrometheusHeaders parses the headers sent with every Prometheus query
+func (c *EnvVars) PrometheusHeaders() (http.Header, error) {
+	headers := make(http.Header)
+	for _, header := range strings.Split(c.PromHeaders, ",") {
+		if strings.TrimSpace(header) == "" {
+			continue
+		}
+		name, value, found := strings.Cut(header, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("prometheusHeaders must be a list of Name=value, got %q", header)
+		}
+		headers.Add(name, strings.TrimSpace(value))
 	}
+	return headers, nil
+}
 
-	transform_path := os.Getenv("TRANSFORM_PATH")
-	if transform_path != "" {
-		result.TransformPath = transform_path
-	} else {
-		logger.Info("TRANSFORM_PATH not set, using default value ./transform")
+// Print writes the configuration as YAML, with the secrets redacted
+func (c *EnvVars) Print(w io.Writer) error {
+	redacted := *c
+	settings := reflect.ValueOf(&redacted).Elem()
+	forEachSetting(func(field reflect.StructField) {
+		value := settings.FieldByName(field.Name)
+		if field.Tag.Get("secret") == "true" && value.String() != "" {
+			value.SetString("<redacted>")
+		}
+	})
+	encoder := yaml.NewEncoder(w)
+	defer encoder.Close()
+	return encoder.Encode(&redacted)
+}
+
+func forEachSetting(fn func(reflect.StructField)) {
+	settings := reflect.TypeOf(EnvVars{})
+	for idx := 0; idx < settings.NumField(); idx++ {
+		fn(settings.Field(idx))
 	}
+}
 
-	return result
+// setValue parses text into the setting, according to its type
+func setValue(value reflect.Value, text string) error {
+	text = strings.TrimSpace(text)
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(text)
+	case reflect.Int:
+		parsed, err := strconv.Atoi(text)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", text)
+		}
+		value.SetInt(int64(parsed))
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", text)
+		}
+		value.SetFloat(parsed)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(text)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", text)
+		}
+		value.SetBool(parsed)
+	default:
+		return fmt.Errorf("unsupported setting type %s", value.Kind())
+	}
+	return nil
 }
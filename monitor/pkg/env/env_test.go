@@ -0,0 +1,32 @@
+package env
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A variable set to the empty string overrides the file, unset ones do not
+func TestLoadEmptyEnvironmentVariableOverridesFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	config := "prometheusServer: http://prometheus:9090\npgDbHost: postgres\n"
+	if err := os.WriteFile(file, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("PROMETHEUS_SERVER", "")
+	t.Setenv("PG_DB_HOST", "")
+	os.Unsetenv("PG_DB_HOST")
+
+	settings, err := Load(flag.NewFlagSet("monitor", flag.ContinueOnError), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.PrometheusServer != "" {
+		t.Errorf("got Prometheus server %q, want the empty value of the environment", settings.PrometheusServer)
+	}
+	if settings.PgDbHost != "postgres" {
+		t.Errorf("got PostgreSQL host %q, want the value of the file", settings.PgDbHost)
+	}
+}
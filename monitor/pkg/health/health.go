@@ -0,0 +1,98 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"klustercost/monitor/pkg/signals"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Check reports an error when the part of the monitor it covers is unhealthy
+type Check func() error
+
+var (
+	lock        sync.Mutex
+	liveChecks  = make(map[string]Check)
+	readyChecks = make(map[string]Check)
+)
+
+// AddLivenessCheck registers a check of /healthz. A failing liveness check
+// gets the monitor restarted, so it must only fail when restarting helps.
+func AddLivenessCheck(name string, check Check) {
+	lock.Lock()
+	defer lock.Unlock()
+	liveChecks[name] = check
+}
+
+// AddReadinessCheck registers a check of /readyz
+func AddReadinessCheck(name string, check Check) {
+	lock.Lock()
+	defer lock.Unlock()
+	readyChecks[name] = check
+}
+
+// Serve serves /healthz, /readyz and the self metrics of the default
+// registry on /metrics until ctx is done.
+func Serve(ctx context.Context, address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", handler(liveChecks))
+	mux.Handle("/readyz", handler(readyChecks))
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{Addr: address, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	signals.Logger.Info("Serving health checks and self metrics", "address", address)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		signals.Logger.Error(err, "Health endpoint stopped")
+	}
+}
+
+// handler runs every check and answers 503 when any of them fails. The body
+// lists the outcome of each check, like the probes of the API server.
+func handler(checks map[string]Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		names := make([]string, 0, len(checks))
+		for name := range checks {
+			names = append(names, name)
+		}
+		current := make(map[string]Check, len(checks))
+		for name, check := range checks {
+			current[name] = check
+		}
+		lock.Unlock()
+		sort.Strings(names)
+
+		var body strings.Builder
+		failed := false
+		for _, name := range names {
+			if err := current[name](); err != nil {
+				failed = true
+				fmt.Fprintf(&body, "[-]%s failed: %v\n", name, err)
+			} else {
+				fmt.Fprintf(&body, "[+]%s ok\n", name)
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if failed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			body.WriteString("check failed\n")
+		} else {
+			body.WriteString("ok\n")
+		}
+		w.Write([]byte(body.String()))
+	})
+}
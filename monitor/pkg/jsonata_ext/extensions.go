@@ -1,80 +1,135 @@
 package jsonata_ext
 
 import (
-	"strconv"
-	"strings"
+	"fmt"
+	"time"
 
 	jsonata "github.com/blues/jsonata-go"
+	"github.com/blues/jsonata-go/jtypes"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 //https://kubernetes.io/docs/concepts/configuration/manage-resources-containers/#resource-units-in-kubernetes
 
-func memory_quantity(src string) (uint64, error) {
-	var multiplier uint64 = 1
-	if strings.HasSuffix(src, "Ki") {
-		src = strings.TrimSuffix(src, "Ki")
-		multiplier = 1024
-	} else if strings.HasSuffix(src, "Mi") {
-		src = strings.TrimSuffix(src, "Mi")
-		multiplier = 1024 * 1024
-	} else if strings.HasSuffix(src, "Gi") {
-		src = strings.TrimSuffix(src, "Gi")
-		multiplier = 1024 * 1024 * 1024
-	} else if strings.HasSuffix(src, "Ti") {
-		src = strings.TrimSuffix(src, "Ti")
-		multiplier = 1024 * 1024 * 1024 * 1024
-	} else if strings.HasSuffix(src, "Pi") {
-		src = strings.TrimSuffix(src, "Pi")
-		multiplier = 1024 * 1024 * 1024 * 1024 * 1024
-	} else if strings.HasSuffix(src, "Ei") {
-		src = strings.TrimSuffix(src, "Ei")
-		multiplier = 1024 * 1024 * 1024 * 1024 * 1024 * 1024
-	} else if strings.HasSuffix(src, "K") {
-		src = strings.TrimSuffix(src, "K")
-		multiplier = 1000
-	} else if strings.HasSuffix(src, "M") {
-		src = strings.TrimSuffix(src, "M")
-		multiplier = 1000 * 1000
-	} else if strings.HasSuffix(src, "G") {
-		src = strings.TrimSuffix(src, "G")
-		multiplier = 1000 * 1000 * 1000
-	} else if strings.HasSuffix(src, "T") {
-		src = strings.TrimSuffix(src, "T")
-		multiplier = 1000 * 1000 * 1000 * 1000
-	} else if strings.HasSuffix(src, "P") {
-		src = strings.TrimSuffix(src, "P")
-		multiplier = 1000 * 1000 * 1000 * 1000 * 1000
-	} else if strings.HasSuffix(src, "E") {
-		src = strings.TrimSuffix(src, "E")
-		multiplier = 1000 * 1000 * 1000 * 1000 * 1000 * 1000
+// parseQuantity reads a quantity with the semantics of the API server, from
+// its serialized form, e.g. "1.5Gi", "500m" or "1e9", or from a plain number
+func parseQuantity(src interface{}) (resource.Quantity, error) {
+	switch value := src.(type) {
+	case string:
+		return resource.ParseQuantity(value)
+	case float64:
+		return resource.ParseQuantity(fmt.Sprint(value))
+	default:
+		return resource.Quantity{}, fmt.Errorf("%v is not a quantity", src)
 	}
+}
+
+// memory_quantity converts a quantity to bytes
+func memory_quantity(src interface{}) (float64, error) {
+	return quantity(src, jtypes.OptionalString{})
+}
 
-	intValue, err := strconv.Atoi(src)
+// cpu_quantity converts a quantity to cores
+func cpu_quantity(src interface{}) (float64, error) {
+	return quantity(src, jtypes.OptionalString{})
+}
+
+// quantity converts a quantity to a multiple of unit, e.g. $quantity("1.5Gi", "Mi")
+// is 1536. Without a unit the quantity is returned in base units.
+func quantity(src interface{}, unit jtypes.OptionalString) (float64, error) {
+	q, err := parseQuantity(src)
 	if err != nil {
 		return 0, err
 	}
-	return uint64(intValue) * multiplier, nil
+	if unit.String == "" {
+		return q.AsApproximateFloat64(), nil
+	}
+	divider, err := resource.ParseQuantity("1" + unit.String)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a quantity unit", unit.String)
+	}
+	return q.AsApproximateFloat64() / divider.AsApproximateFloat64(), nil
 }
 
-func cpu_quantity(src string) (float64, error) {
-	divider := 1.0
-	if strings.HasSuffix(src, "m") {
-		src = strings.TrimSuffix(src, "m")
-		divider = 1000.0
+// duration converts a duration such as "1h30m" or "250ms" to seconds
+func duration(src string) (float64, error) {
+	d, err := time.ParseDuration(src)
+	if err != nil {
+		return 0, err
 	}
-	floatValue, err := strconv.ParseFloat(src, 64)
+	return d.Seconds(), nil
+}
+
+// parse_time converts a timestamp of the API server to seconds since the epoch
+func parse_time(src string) (float64, error) {
+	t, err := time.Parse(time.RFC3339Nano, src)
 	if err != nil {
 		return 0, err
 	}
-	return floatValue / divider, nil
+	return float64(t.UnixNano()) / float64(time.Second), nil
 }
 
+// age returns the seconds elapsed since a timestamp of the API server, until
+// now or until the second timestamp, e.g. $age(status.startTime)
+func age(src string, until jtypes.OptionalString) (float64, error) {
+	t, err := time.Parse(time.RFC3339Nano, src)
+	if err != nil {
+		return 0, err
+	}
+	end := time.Now()
+	if until.IsSet() {
+		if end, err = time.Parse(time.RFC3339Nano, until.String); err != nil {
+			return 0, err
+		}
+	}
+	return end.Sub(t).Seconds(), nil
+}
+
+// Undefined input, e.g. a missing limit, gives an undefined result rather than an error
+var undefinedInput = jtypes.ArgUndefined(0)
+
 var exts = map[string]jsonata.Extension{
 	"memory_quantity": {
-		Func: memory_quantity,
+		Func:             memory_quantity,
+		UndefinedHandler: undefinedInput,
 	},
 	"cpu_quantity": {
-		Func: cpu_quantity,
+		Func:             cpu_quantity,
+		UndefinedHandler: undefinedInput,
+	},
+	"quantity": {
+		Func:             quantity,
+		UndefinedHandler: undefinedInput,
+	},
+	"duration": {
+		Func:             duration,
+		UndefinedHandler: undefinedInput,
+	},
+	"parse_time": {
+		Func:             parse_time,
+		UndefinedHandler: undefinedInput,
+	},
+	"age": {
+		Func:             age,
+		UndefinedHandler: undefinedInput,
+	},
+	"effective_requests": {
+		Func:               effective_requests,
+		UndefinedHandler:   undefinedInput,
+		EvalContextHandler: podContext,
+	},
+	"effective_limits": {
+		Func:               effective_limits,
+		UndefinedHandler:   undefinedInput,
+		EvalContextHandler: podContext,
+	},
+	"extended_resources": {
+		Func:             extended_resources,
+		UndefinedHandler: undefinedInput,
+	},
+	"gpus": {
+		Func:             gpus,
+		UndefinedHandler: undefinedInput,
 	},
 }
 
@@ -0,0 +1,164 @@
+package jsonata_ext
+
+import (
+	"encoding/json"
+	"fmt"
+	"klustercost/monitor/pkg/env"
+	"strings"
+
+	"github.com/blues/jsonata-go/jtypes"
+	v1 "k8s.io/api/core/v1"
+	podresource "k8s.io/component-helpers/resource"
+)
+
+// effective_requests returns the requests the scheduler accounts for a pod,
+// by resource name in base units, e.g. {"cpu": 0.5, "memory": 268435456}
+func effective_requests(pod interface{}) (map[string]interface{}, error) {
+	spec, err := podSpec(pod)
+	if err != nil {
+		return nil, err
+	}
+	return resourceValues(podResources(spec, func(r v1.ResourceRequirements) v1.ResourceList { return r.Requests }, true)), nil
+}
+
+// effective_limits returns the limits of a pod, computed like its requests.
+// A resource without a limit in any container is left out.
+func effective_limits(pod interface{}) (map[string]interface{}, error) {
+	spec, err := podSpec(pod)
+	if err != nil {
+		return nil, err
+	}
+	return resourceValues(podResources(spec, func(r v1.ResourceRequirements) v1.ResourceList { return r.Limits }, false)), nil
+}
+
+func podSpec(pod interface{}) (*v1.PodSpec, error) {
+	data, err := json.Marshal(pod)
+	if err != nil {
+		return nil, err
+	}
+	var object v1.Pod
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, fmt.Errorf("not a pod: %w", err)
+	}
+	return &object.Spec, nil
+}
+
+// podResources follows the calculation of the scheduler: the app containers
+// and the restartable init containers (sidecars) run together, while every
+// other init container runs alone next to the sidecars started before it.
+// The pod needs the larger of both, unless the pod-level resources of its
+// spec set the resource (cpu, memory and hugepages), plus the overhead of
+// its RuntimeClass. The overhead only adds to the limits that are set.
+func podResources(spec *v1.PodSpec, of func(v1.ResourceRequirements) v1.ResourceList, isRequest bool) v1.ResourceList {
+	result := v1.ResourceList{}
+	for _, container := range spec.Containers {
+		addResources(result, of(container.Resources))
+	}
+
+	sidecars := v1.ResourceList{}
+	initPeak := v1.ResourceList{}
+	for _, container := range spec.InitContainers {
+		resources := of(container.Resources)
+		if container.RestartPolicy != nil && *container.RestartPolicy == v1.ContainerRestartPolicyAlways {
+			addResources(result, resources)
+			addResources(sidecars, resources)
+			resources = sidecars
+		} else {
+			running := v1.ResourceList{}
+			addResources(running, resources)
+			addResources(running, sidecars)
+			resources = running
+		}
+		maxResources(initPeak, resources)
+	}
+	maxResources(result, initPeak)
+
+	if spec.Resources != nil {
+		for name, quantity := range of(*spec.Resources) {
+			if podresource.IsSupportedPodLevelResource(name) {
+				result[name] = quantity.DeepCopy()
+			}
+		}
+	}
+
+	for name, overhead := range spec.Overhead {
+		if value, exists := result[name]; exists || isRequest {
+			value.Add(overhead)
+			result[name] = value
+		}
+	}
+	return result
+}
+
+func addResources(to v1.ResourceList, from v1.ResourceList) {
+	for name, quantity := range from {
+		value := to[name]
+		value.Add(quantity)
+		to[name] = value
+	}
+}
+
+func maxResources(to v1.ResourceList, from v1.ResourceList) {
+	for name, quantity := range from {
+		if value, exists := to[name]; !exists || quantity.Cmp(value) > 0 {
+			to[name] = quantity.DeepCopy()
+		}
+	}
+}
+
+func resourceValues(resources v1.ResourceList) map[string]interface{} {
+	values := make(map[string]interface{}, len(resources))
+	for name, quantity := range resources {
+		values[string(name)] = quantity.AsApproximateFloat64()
+	}
+	return values
+}
+
+// extended_resources keeps the configured extended resources of a resource
+// list, e.g. status.allocatable or $effective_requests(), in base units
+func extended_resources(list interface{}) (map[string]interface{}, error) {
+	resources, ok := list.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v is not a resource list", list)
+	}
+	result := make(map[string]interface{})
+	for _, name := range extendedResourceNames() {
+		if value, exists := resources[name]; exists {
+			q, err := quantity(value, jtypes.OptionalString{})
+			if err != nil {
+				return nil, err
+			}
+			result[name] = q
+		}
+	}
+	return result, nil
+}
+
+// gpus sums the configured extended resources named */gpu of a resource list,
+// e.g. nvidia.com/gpu and amd.com/gpu
+func gpus(list interface{}) (float64, error) {
+	resources, err := extended_resources(list)
+	if err != nil {
+		return 0, err
+	}
+	var total float64
+	for name, value := range resources {
+		if strings.HasSuffix(name, "/gpu") {
+			total += value.(float64)
+		}
+	}
+	return total, nil
+}
+
+func extendedResourceNames() []string {
+	var names []string
+	for _, name := range strings.Split(env.EnvironmentVariables.ExtendedResources, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Called without arguments, e.g. $effective_requests(), they apply to the pod being transformed
+var podContext = jtypes.ArgCountEquals(0)
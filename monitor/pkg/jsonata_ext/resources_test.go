@@ -0,0 +1,181 @@
+package jsonata_ext
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	podresource "k8s.io/component-helpers/resource"
+)
+
+func resources(cpu, memory string) v1.ResourceList {
+	list := v1.ResourceList{}
+	if cpu != "" {
+		list[v1.ResourceCPU] = resource.MustParse(cpu)
+	}
+	if memory != "" {
+		list[v1.ResourceMemory] = resource.MustParse(memory)
+	}
+	return list
+}
+
+func container(name string, requests, limits v1.ResourceList) v1.Container {
+	return v1.Container{Name: name, Resources: v1.ResourceRequirements{Requests: requests, Limits: limits}}
+}
+
+func sidecar(name string, requests, limits v1.ResourceList) v1.Container {
+	always := v1.ContainerRestartPolicyAlways
+	c := container(name, requests, limits)
+	c.RestartPolicy = &always
+	return c
+}
+
+// podResources must account a pod like the scheduler does
+func TestPodResources(t *testing.T) {
+	tests := []struct {
+		name string
+		spec v1.PodSpec
+	}{
+		{
+			name: "app containers",
+			spec: v1.PodSpec{
+				Containers: []v1.Container{
+					container("app", resources("500m", "256Mi"), resources("1", "512Mi")),
+					container("proxy", resources("100m", "64Mi"), nil),
+				},
+			},
+		},
+		{
+			name: "init container peak above the app containers",
+			spec: v1.PodSpec{
+				InitContainers: []v1.Container{
+					container("migrate", resources("2", "1Gi"), resources("4", "2Gi")),
+				},
+				Containers: []v1.Container{
+					container("app", resources("500m", "256Mi"), resources("1", "512Mi")),
+				},
+			},
+		},
+		{
+			name: "init container below the app containers",
+			spec: v1.PodSpec{
+				InitContainers: []v1.Container{
+					container("wait", resources("10m", "16Mi"), nil),
+				},
+				Containers: []v1.Container{
+					container("app", resources("500m", "256Mi"), resources("1", "512Mi")),
+				},
+			},
+		},
+		{
+			name: "init container after a sidecar runs next to it",
+			spec: v1.PodSpec{
+				InitContainers: []v1.Container{
+					sidecar("mesh", resources("200m", "128Mi"), resources("400m", "256Mi")),
+					container("migrate", resources("1", "512Mi"), resources("2", "1Gi")),
+				},
+				Containers: []v1.Container{
+					container("app", resources("500m", "256Mi"), resources("1", "512Mi")),
+				},
+			},
+		},
+		{
+			name: "init container before a sidecar runs alone",
+			spec: v1.PodSpec{
+				InitContainers: []v1.Container{
+					container("migrate", resources("1", "512Mi"), resources("2", "1Gi")),
+					sidecar("mesh", resources("200m", "128Mi"), resources("400m", "256Mi")),
+				},
+				Containers: []v1.Container{
+					container("app", resources("500m", "256Mi"), resources("1", "512Mi")),
+				},
+			},
+		},
+		{
+			name: "sidecars add up before a later init container",
+			spec: v1.PodSpec{
+				InitContainers: []v1.Container{
+					sidecar("mesh", resources("200m", "128Mi"), nil),
+					sidecar("logs", resources("100m", "64Mi"), nil),
+					container("migrate", resources("1500m", "1Gi"), nil),
+				},
+				Containers: []v1.Container{
+					container("app", resources("500m", "256Mi"), nil),
+				},
+			},
+		},
+		{
+			name: "overhead with limits set",
+			spec: v1.PodSpec{
+				Containers: []v1.Container{
+					container("app", resources("500m", "256Mi"), resources("1", "512Mi")),
+				},
+				Overhead: resources("250m", "120Mi"),
+			},
+		},
+		{
+			name: "overhead only on the limits that are set",
+			spec: v1.PodSpec{
+				Containers: []v1.Container{
+					container("app", resources("500m", "256Mi"), resources("", "512Mi")),
+				},
+				Overhead: resources("250m", "120Mi"),
+			},
+		},
+		{
+			name: "pod-level resources",
+			spec: v1.PodSpec{
+				Containers: []v1.Container{
+					container("app", resources("500m", "256Mi"), nil),
+					container("proxy", nil, nil),
+				},
+				Resources: &v1.ResourceRequirements{Requests: resources("1", "1Gi"), Limits: resources("2", "2Gi")},
+			},
+		},
+		{
+			name: "pod-level resources of one resource only",
+			spec: v1.PodSpec{
+				Containers: []v1.Container{
+					container("app", resources("500m", "256Mi"), resources("1", "512Mi")),
+				},
+				Resources: &v1.ResourceRequirements{Requests: resources("", "1Gi"), Limits: resources("", "1Gi")},
+				Overhead:  resources("250m", "120Mi"),
+			},
+		},
+		{
+			name: "overhead without limits",
+			spec: v1.PodSpec{
+				Containers: []v1.Container{
+					container("app", resources("500m", "256Mi"), nil),
+				},
+				Overhead: resources("250m", "120Mi"),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := &v1.Pod{Spec: test.spec}
+
+			requests := podResources(&test.spec, func(r v1.ResourceRequirements) v1.ResourceList { return r.Requests }, true)
+			compareResources(t, "requests", requests, podresource.PodRequests(pod, podresource.PodResourcesOptions{}))
+
+			limits := podResources(&test.spec, func(r v1.ResourceRequirements) v1.ResourceList { return r.Limits }, false)
+			compareResources(t, "limits", limits, podresource.PodLimits(pod, podresource.PodResourcesOptions{}))
+		})
+	}
+}
+
+func compareResources(t *testing.T, kind string, got, want v1.ResourceList) {
+	t.Helper()
+	for name, quantity := range want {
+		if value, exists := got[name]; !exists || value.Cmp(quantity) != 0 {
+			t.Errorf("%s %s: got %v, want %s", kind, name, got[name], quantity.String())
+		}
+	}
+	for name, quantity := range got {
+		if _, exists := want[name]; !exists {
+			t.Errorf("%s %s: got %s, want none", kind, name, quantity.String())
+		}
+	}
+}
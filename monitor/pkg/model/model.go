@@ -1,17 +1,47 @@
 package model
 
+import "time"
+
 type DataExchange map[string]interface{}
 
-// NodeMisc is a struct that contains the node miscellaneous information
-// It is used to insert data into the database
-// Used by node-controller.go
-type NodeMisc struct {
-	Memory       float64
-	CPU          float64
-	UID          string
-	Labels       string
-	InstanceType string
-	Region       string
-	Zone         string
-	OS           string
+// Controller identifies the top-level workload owning a pod
+// (Deployment, StatefulSet, DaemonSet, CronJob, a CRD, or the pod itself)
+// Used by pod-controller.go
+type Controller struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	UID  string `json:"uid"`
+}
+
+// Kinds of observed objects that have an end-of-life record
+const (
+	KindPod  = "Pod"
+	KindNode = "Node"
+	// PersistentVolumeClaims sampled by the storage controller, kept apart
+	// from the PersistentVolumeClaim objects recorded through OBSERVED_KINDS
+	KindVolume = "Volume"
+)
+
+// ObjectRef identifies an observed object in the persistence layer
+// Pods are identified by UID, nodes by Name
+type ObjectRef struct {
+	Kind      string
+	UID       string
+	Name      string
+	Namespace string
+}
+
+// ActiveObject is an object without an end of life in the persistence layer
+// LastSeen is the time of its last sample, zero when the backend has none
+type ActiveObject struct {
+	ObjectRef
+	LastSeen time.Time
+}
+
+// Termination records when an observed object stopped existing and its last known state
+// Used by pod-controller.go, node-controller.go and storage-controller.go
+type Termination struct {
+	ObjectRef
+	Timestamp  time.Time
+	FinalState string
 }
@@ -1,6 +1,10 @@
 package observer
 
+import "context"
+
 type Controller interface {
-	Run(int) error
+	// Run processes the observed objects until ctx is done, then stops the
+	// workers and returns once the items being processed are finished.
+	Run(context.Context, int) error
 	FriendlyName() string
 }
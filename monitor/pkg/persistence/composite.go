@@ -0,0 +1,201 @@
+package persistence
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"klustercost/monitor/pkg/model"
+	"klustercost/monitor/pkg/signals"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Number of writes a sink can fall behind before new writes to it are dropped
+const sinkQueueSize = 1000
+
+// Retry policy applied by every sink independently
+var sinkBackoff = wait.Backoff{
+	Duration: time.Second,
+	Factor:   2,
+	Steps:    5,
+	Cap:      30 * time.Second,
+}
+
+// Writes a secondary backend never applied: dropped when its queue was full,
+// rejected, out of retries or still queued on shutdown
+var droppedWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "klustercost_persistence_dropped_writes_total",
+	Help: "Writes dropped by a secondary persistence backend.",
+}, []string{"persistence"})
+
+func init() {
+	prometheus.MustRegister(droppedWrites)
+}
+
+type write func(Persistence) error
+
+// sink owns the queue and the retries of a secondary persistence backend,
+// so a slow or failing backend only delays its own writes.
+type sink struct {
+	name  string
+	impl  Persistence
+	queue chan write
+	done  chan struct{}
+}
+
+func newSink(name string, impl Persistence) *sink {
+	return &sink{
+		name:  name,
+		impl:  impl,
+		queue: make(chan write, sinkQueueSize),
+		done:  make(chan struct{}),
+	}
+}
+
+// enqueue hands the write to the sink without ever blocking the caller
+func (s *sink) enqueue(w write) error {
+	select {
+	case s.queue <- w:
+		return nil
+	default:
+		err := fmt.Errorf("persistence %s is %d writes behind, dropping write", s.name, sinkQueueSize)
+		signals.Logger.Error(err, "Klustercost: persistence sink overloaded")
+		droppedWrites.WithLabelValues(s.name).Inc()
+		return err
+	}
+}
+
+func (s *sink) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for w := range s.queue {
+		s.write(w)
+	}
+}
+
+// write applies w with the sink backoff, giving up early on shutdown
+func (s *sink) write(w write) {
+	backoff := sinkBackoff
+	for {
+		err := w(s.impl)
+		if err == nil {
+			return
+		}
+		if !IsTransient(err) {
+			signals.Logger.Error(err, "Klustercost: dropping rejected persistence write", "persistence", s.name)
+			droppedWrites.WithLabelValues(s.name).Inc()
+			return
+		}
+		if backoff.Steps <= 1 {
+			signals.Logger.Error(err, "Klustercost: giving up on persistence write", "persistence", s.name)
+			droppedWrites.WithLabelValues(s.name).Inc()
+			return
+		}
+		delay := backoff.Step()
+		signals.Logger.Error(err, "Klustercost: persistence write failed, retrying", "persistence", s.name, "after", delay)
+		select {
+		case <-time.After(delay):
+		case <-s.done:
+			signals.Logger.Error(err, "Klustercost: dropping persistence write on shutdown", "persistence", s.name)
+			droppedWrites.WithLabelValues(s.name).Inc()
+			return
+		}
+	}
+}
+
+// composite fans every write out to several persistence backends. The
+// primary backend, the first one configured, is written synchronously, so
+// its failures reach the controllers and are retried there, exactly as
+// with a single backend. The secondary backends are written through their
+// sinks; their failures are retried by the sink, logged and counted in
+// klustercost_persistence_dropped_writes_total, but never fail the write.
+type composite struct {
+	primary     Persistence
+	primaryName string
+	sinks       []*sink
+	wg          sync.WaitGroup
+	lock        sync.RWMutex
+	closed      bool
+}
+
+func newComposite(primaryName string, primary Persistence, sinks []*sink) *composite {
+	c := &composite{primary: primary, primaryName: primaryName, sinks: sinks}
+	for _, s := range sinks {
+		c.wg.Add(1)
+		go s.run(&c.wg)
+	}
+	return c
+}
+
+// fanOut applies w to the primary backend and, once it succeeded, queues it
+// on every secondary sink. A failed write is retried by the controller and
+// must not reach the secondaries once per attempt.
+func (c *composite) fanOut(w write) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.closed {
+		return fmt.Errorf("persistence is closed")
+	}
+
+	if err := w(c.primary); err != nil {
+		return err
+	}
+	for _, s := range c.sinks {
+		s.enqueue(w)
+	}
+	return nil
+}
+
+func (c *composite) InsertNodeJson(node_json string) error {
+	return c.fanOut(func(p Persistence) error { return p.InsertNodeJson(node_json) })
+}
+
+func (c *composite) InsertPodJson(pod_json string) error {
+	return c.fanOut(func(p Persistence) error { return p.InsertPodJson(pod_json) })
+}
+
+func (c *composite) InsertVolumeJson(volume_json string) error {
+	return c.fanOut(func(p Persistence) error { return p.InsertVolumeJson(volume_json) })
+}
+
+func (c *composite) InsertObjectJson(kind string, object_json string) error {
+	return c.fanOut(func(p Persistence) error { return p.InsertObjectJson(kind, object_json) })
+}
+
+func (c *composite) RecordTermination(termination *model.Termination) error {
+	return c.fanOut(func(p Persistence) error { return p.RecordTermination(termination) })
+}
+
+// ListActive returns the objects active in the primary backend. The
+// secondaries are best effort and receive the terminations it leads to.
+func (c *composite) ListActive(kind string) ([]model.ActiveObject, error) {
+	refs, err := c.primary.ListActive(kind)
+	if err != nil {
+		return nil, fmt.Errorf("persistence %s: %w", c.primaryName, err)
+	}
+	return refs, nil
+}
+
+// Ping checks the primary backend only. The secondary sinks retry and drop
+// writes on their own, an outage there shows in klustercost_persistence_dropped_writes_total
+// and must not take the monitor out of service.
+func (c *composite) Ping() error {
+	if err := c.primary.Ping(); err != nil {
+		return fmt.Errorf("persistence %s: %w", c.primaryName, err)
+	}
+	return nil
+}
+
+// Close stops retrying, writes what is still queued and waits for every secondary sink
+func (c *composite) Close() {
+	c.lock.Lock()
+	c.closed = true
+	c.lock.Unlock()
+
+	for _, s := range c.sinks {
+		close(s.done)
+		close(s.queue)
+	}
+	c.wg.Wait()
+}
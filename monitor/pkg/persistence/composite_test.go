@@ -0,0 +1,77 @@
+package persistence
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"klustercost/monitor/pkg/model"
+)
+
+// recorder is a backend that keeps the pods written to it and fails the
+// given number of writes first
+type recorder struct {
+	lock     sync.Mutex
+	failures int
+	pods     []string
+	active   []model.ActiveObject
+	listErr  error
+}
+
+func (r *recorder) InsertNodeJson(string) error                { return nil }
+func (r *recorder) InsertVolumeJson(string) error              { return nil }
+func (r *recorder) InsertObjectJson(string, string) error      { return nil }
+func (r *recorder) RecordTermination(*model.Termination) error { return nil }
+func (r *recorder) Ping() error                                { return nil }
+
+func (r *recorder) InsertPodJson(pod_json string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		return errors.New("unavailable")
+	}
+	r.pods = append(r.pods, pod_json)
+	return nil
+}
+
+func (r *recorder) ListActive(string) ([]model.ActiveObject, error) {
+	return r.active, r.listErr
+}
+
+func TestCompositeWritesSecondariesOnceThePrimarySucceeded(t *testing.T) {
+	primary := &recorder{failures: 1}
+	secondary := &recorder{}
+	c := newComposite("primary", primary, []*sink{newSink("secondary", secondary)})
+
+	// The controller retries the write the primary failed
+	if err := c.InsertPodJson(`{"uid":"a"}`); err == nil {
+		t.Fatal("got no error from the failing primary")
+	}
+	if err := c.InsertPodJson(`{"uid":"a"}`); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if len(primary.pods) != 1 {
+		t.Errorf("primary got %d writes, want 1", len(primary.pods))
+	}
+	if len(secondary.pods) != 1 {
+		t.Errorf("secondary got %d writes, want 1", len(secondary.pods))
+	}
+}
+
+func TestCompositeListsActiveObjectsOfThePrimary(t *testing.T) {
+	primary := &recorder{active: []model.ActiveObject{{ObjectRef: model.ObjectRef{Kind: model.KindPod, UID: "a"}}}}
+	secondary := &recorder{listErr: errors.New("unavailable")}
+	c := newComposite("primary", primary, []*sink{newSink("secondary", secondary)})
+	defer c.Close()
+
+	refs, err := c.ListActive(model.KindPod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0].UID != "a" {
+		t.Errorf("got %v, want the objects of the primary", refs)
+	}
+}
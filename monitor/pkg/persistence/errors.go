@@ -0,0 +1,19 @@
+package persistence
+
+import "errors"
+
+// temporary is implemented by the errors of persistence backends that can
+// tell transient failures (worth retrying) from permanent ones.
+type temporary interface {
+	Temporary() bool
+}
+
+// IsTransient reports whether a failed write may succeed when retried.
+// Errors that do not say otherwise are assumed to be transient.
+func IsTransient(err error) bool {
+	var t temporary
+	if errors.As(err, &t) {
+		return t.Temporary()
+	}
+	return true
+}
@@ -1,37 +1,104 @@
 package persistence
 
 import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"klustercost/monitor/pkg/env"
 	"klustercost/monitor/pkg/postgres"
-	//TODO: enumerate here any other supported persistence implementation
+	"klustercost/monitor/pkg/prometheus_exporter"
+	"klustercost/monitor/pkg/signals"
+
 	"k8s.io/klog/v2"
 )
 
+// Names of the supported persistence backends, as used in the PERSISTENCE setting
 const (
-	POSTGRESS = iota
-	PROMETHEUS
+	POSTGRES   = "postgres"
+	PROMETHEUS = "prometheus"
 )
 
-// TODO: read from environment variable and call the correct persistence package: postgres, prometheus, so on
-var persistence_type = POSTGRESS
+// Backend opens and closes one persistence implementation
+type Backend struct {
+	Open  func() Persistence
+	Close func()
+}
+
+var backends = map[string]Backend{
+	POSTGRES: {
+		Open:  func() Persistence { return postgres.GetPersistInterface().(Persistence) },
+		Close: postgres.ClosePersistInterface,
+	},
+	PROMETHEUS: {
+		Open:  func() Persistence { return prometheus_exporter.GetPersistInterface().(Persistence) },
+		Close: prometheus_exporter.ClosePersistInterface,
+	},
+}
+
+var (
+	persistence_once  sync.Once
+	persistence_impl  Persistence
+	persistence_used  []string
+	persistence_ready atomic.Bool
+)
+
+// Register makes a persistence backend selectable by name in the PERSISTENCE setting.
+// It must be called before the first call to GetPersistInterface.
+func Register(name string, backend Backend) {
+	backends[name] = backend
+}
 
+// GetPersistInterface returns the persistence selected by the comma separated
+// PERSISTENCE setting. When several backends are selected, every write is
+// fanned out to all of them; only the first one decides whether it failed.
 func GetPersistInterface() Persistence {
-	switch persistence_type {
-	case POSTGRESS:
-		return postgres.GetPersistInterface().(Persistence)
-	default:
-		//nc.logger.Error(err, "Klustercost:  persistence not supported (PROMETHEUS)")
-		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
-		return nil
-	}
+	persistence_once.Do(func() {
+		var primary Persistence
+		var sinks []*sink
+		for _, name := range strings.Split(env.EnvironmentVariables.Persistence, ",") {
+			name = strings.TrimSpace(name)
+			backend, exists := backends[name]
+			if !exists {
+				signals.Logger.Info("Klustercost: persistence not supported", "persistence", name)
+				klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+			}
+			persistence_used = append(persistence_used, name)
+			if primary == nil {
+				primary = backend.Open()
+			} else {
+				sinks = append(sinks, newSink(name, backend.Open()))
+			}
+		}
+
+		if len(sinks) == 0 {
+			persistence_impl = primary
+		} else {
+			persistence_impl = newComposite(persistence_used[0], primary, sinks)
+		}
+		signals.Logger.Info("Klustercost: persistence initialized", "backends", persistence_used)
+		persistence_ready.Store(true)
+	})
+
+	return persistence_impl
+}
+
+// Ready tells whether GetPersistInterface has opened the backends, without
+// waiting for it. Opening the database waits until its schema is migrated.
+func Ready() bool {
+	return persistence_ready.Load()
 }
 
+// Close closes the backends. It does nothing before they were opened, their
+// setup stops on its own when the monitor shuts down.
 func Close() {
-	switch persistence_type {
-	case POSTGRESS:
-		postgres.ClosePersistInterface()
-		break
-	default:
-		break
+	if !Ready() {
+		return
+	}
+	if c, ok := persistence_impl.(*composite); ok {
+		c.Close()
+	}
+	for _, name := range persistence_used {
+		backends[name].Close()
 	}
-
 }
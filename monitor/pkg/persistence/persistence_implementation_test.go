@@ -0,0 +1,34 @@
+package persistence
+
+import (
+	"testing"
+	"time"
+
+	"klustercost/monitor/pkg/env"
+)
+
+// The readiness probe asks Ready while the backends are still being opened,
+// e.g. while the database migrates, and must get an answer right away
+func TestReadyDoesNotWaitForTheBackends(t *testing.T) {
+	opening := make(chan struct{})
+	Register("slow", Backend{
+		Open:  func() Persistence { <-opening; return &recorder{} },
+		Close: func() {},
+	})
+	env.EnvironmentVariables = env.Defaults()
+	env.EnvironmentVariables.Persistence = "slow"
+
+	go GetPersistInterface()
+	if Ready() {
+		t.Fatal("ready before the backend was opened")
+	}
+
+	close(opening)
+	deadline := time.Now().Add(5 * time.Second)
+	for !Ready() {
+		if time.Now().After(deadline) {
+			t.Fatal("not ready after the backend was opened")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
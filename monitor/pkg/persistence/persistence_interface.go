@@ -3,6 +3,16 @@ package persistence
 import "klustercost/monitor/pkg/model"
 
 type Persistence interface {
-	InsertNode(string, *model.NodeMisc) error
+	InsertNodeJson(string) error
 	InsertPodJson(string) error
+	// Stores a sample of a PersistentVolumeClaim taken by the storage controller
+	InsertVolumeJson(volume_json string) error
+	// Stores the transformed JSON of an object of any other kind
+	InsertObjectJson(kind string, object_json string) error
+	// Records the end of life of an object
+	RecordTermination(*model.Termination) error
+	// Lists the objects of the given kind that have no end of life recorded
+	ListActive(kind string) ([]model.ActiveObject, error)
+	// Checks that the backend is reachable
+	Ping() error
 }
@@ -0,0 +1,212 @@
+package postgres
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"klustercost/monitor/pkg/model"
+	"klustercost/monitor/pkg/signals"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// How many batches may be waiting in the buffer before writers are pushed back
+const maxBufferedBatches = 10
+
+var (
+	flushDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "klustercost_postgres_flush_duration_seconds",
+		Help:    "Time taken to write one batch of pod samples to Postgres.",
+		Buckets: prometheus.DefBuckets,
+	})
+	flushBatchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "klustercost_postgres_flush_batch_size",
+		Help:    "Number of pod samples written to Postgres in one batch.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	})
+	flushFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "klustercost_postgres_flush_failures_total",
+		Help: "Number of batches of pod samples that could not be written to Postgres.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(flushDuration, flushBatchSize, flushFailures)
+}
+
+// podSample is one element of the batch handed to klustercost.register_pod_json_batch:
+// either a pod sample or the end of life of a pod
+type podSample struct {
+	Timestamp   time.Time       `json:"timestamp"`
+	Pod         json.RawMessage `json:"pod,omitempty"`
+	Termination *podTermination `json:"termination,omitempty"`
+}
+
+type podTermination struct {
+	UID        string    `json:"uid"`
+	Name       string    `json:"name"`
+	Namespace  string    `json:"namespace"`
+	Timestamp  time.Time `json:"timestamp"`
+	FinalState string    `json:"final_state,omitempty"`
+}
+
+// writeBuffer collects the pod samples and terminations of all workers and
+// writes them to the database in batches, once batchSize samples are waiting
+// or every flushInterval, whichever comes first. Only the run loop flushes,
+// so the batches are written one at a time and in the order they were queued.
+type writeBuffer struct {
+	pg            *persistence_pg
+	batchSize     int
+	flushInterval time.Duration
+
+	lock    sync.Mutex
+	samples []podSample
+
+	full chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newWriteBuffer(pg *persistence_pg, batchSize int, flushInterval time.Duration) *writeBuffer {
+	b := &writeBuffer{
+		pg:            pg,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		full:          make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+	b.wg.Add(1)
+	go b.run()
+	return b
+}
+
+// add queues a pod sample. It fails with a transient error while the
+// database is too far behind, so the caller retries later instead of
+// growing the buffer without bounds.
+func (b *writeBuffer) add(pod_json string) error {
+	return b.queue("buffer pod", podSample{Timestamp: time.Now(), Pod: json.RawMessage(pod_json)})
+}
+
+// addTermination queues the end of life of a pod behind its samples, so it
+// is written after them and cannot miss the row of a pod sampled just before
+func (b *writeBuffer) addTermination(termination *model.Termination) error {
+	return b.queue("buffer termination", podSample{
+		Timestamp: time.Now(),
+		Termination: &podTermination{
+			UID:        termination.UID,
+			Name:       termination.Name,
+			Namespace:  termination.Namespace,
+			Timestamp:  termination.Timestamp,
+			FinalState: termination.FinalState,
+		},
+	})
+}
+
+func (b *writeBuffer) queue(op string, sample podSample) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(b.samples) >= b.batchSize*maxBufferedBatches {
+		return &WriteError{Op: op, Err: fmt.Errorf("%d samples waiting to be written", len(b.samples)), Transient: true}
+	}
+
+	b.samples = append(b.samples, sample)
+	if len(b.samples) >= b.batchSize {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (b *writeBuffer) run() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			b.flush()
+			return
+		case <-ticker.C:
+		case <-b.full:
+		}
+		b.flush()
+	}
+}
+
+// flush writes everything buffered so far. Samples that failed with a
+// transient error are put back to be retried on the next flush.
+func (b *writeBuffer) flush() {
+	b.lock.Lock()
+	samples := b.samples
+	b.samples = nil
+	b.lock.Unlock()
+
+	for len(samples) > 0 {
+		batch := samples[:min(b.batchSize, len(samples))]
+		consumed, err := b.write(batch)
+		samples = samples[consumed:]
+		if err != nil {
+			b.lock.Lock()
+			b.samples = append(samples, b.samples...)
+			b.lock.Unlock()
+			return
+		}
+	}
+}
+
+// write stores a batch and returns how many of its leading samples were
+// consumed. When the batch is rejected by the database, it is split until
+// the offending samples are isolated and dropped, so a single bad sample
+// does not cost the whole batch.
+func (b *writeBuffer) write(batch []podSample) (int, error) {
+	batchJson, err := json.Marshal(batch)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	err = b.pg.exec("insert pod batch", "CALL klustercost.register_pod_json_batch($1)", string(batchJson))
+	flushDuration.Observe(time.Since(start).Seconds())
+
+	if err == nil {
+		flushBatchSize.Observe(float64(len(batch)))
+		signals.Logger.V(2).Info("Flushed pod samples", "count", len(batch), "duration", time.Since(start))
+		return len(batch), nil
+	}
+
+	flushFailures.Inc()
+	if isTransient(err) {
+		signals.Logger.Error(err, "Unable to flush pod samples, keeping them for the next flush", "count", len(batch))
+		return 0, err
+	}
+
+	if len(batch) == 1 {
+		if batch[0].Termination != nil {
+			signals.Logger.Error(err, "Dropping pod termination rejected by the database", "uid", batch[0].Termination.UID)
+		} else {
+			signals.Logger.Error(err, "Dropping pod sample rejected by the database", "pod data", string(batch[0].Pod))
+		}
+		return 1, nil
+	}
+
+	half := len(batch) / 2
+	consumed, err := b.write(batch[:half])
+	if err != nil {
+		return consumed, err
+	}
+	consumed, err = b.write(batch[half:])
+	return half + consumed, err
+}
+
+// close writes what is still buffered and stops the flushing goroutine
+func (b *writeBuffer) close() {
+	close(b.done)
+	b.wg.Wait()
+}
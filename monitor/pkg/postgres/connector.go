@@ -0,0 +1,96 @@
+package postgres
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"klustercost/monitor/pkg/env"
+	"klustercost/monitor/pkg/signals"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// connector opens every connection with the credentials found on disk at that
+// moment. Together with the maximum connection lifetime, rotated passwords and
+// certificates are picked up without restarting the monitor.
+type connector struct {
+	settings *env.EnvVars
+
+	lock     sync.Mutex
+	password string
+	fromFile bool
+}
+
+func newConnector(settings *env.EnvVars) *connector {
+	return &connector{settings: settings, password: settings.PgDbPass}
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	password, err := c.currentPassword()
+	if err != nil {
+		return nil, err
+	}
+	pqConnector, err := pq.NewConnector(c.dsn(password))
+	if err != nil {
+		return nil, err
+	}
+	return pqConnector.Connect(ctx)
+}
+
+func (c *connector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// currentPassword reads the password file, when there is one
+func (c *connector) currentPassword() (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.settings.PgDbPassFile == "" {
+		return c.password, nil
+	}
+	data, err := os.ReadFile(c.settings.PgDbPassFile)
+	if err != nil {
+		return "", fmt.Errorf("reading the PostgreSQL password file: %w", err)
+	}
+	password := strings.TrimRight(string(data), "\r\n")
+	if c.fromFile && password != c.password {
+		signals.Logger.Info("PostgreSQL password changed, using it for new connections", "file", c.settings.PgDbPassFile)
+	}
+	c.password = password
+	c.fromFile = true
+	return password, nil
+}
+
+// dsn builds the connection string. The certificate files are named rather
+// than loaded, so lib/pq reads them again for every connection.
+func (c *connector) dsn(password string) string {
+	settings := []struct{ key, value string }{
+		{"user", c.settings.PgDbUser},
+		{"password", password},
+		{"dbname", c.settings.PgDbName},
+		{"host", c.settings.PgDbHost},
+		{"port", fmt.Sprint(c.settings.PgDbPort)},
+		{"sslmode", c.settings.PgSslMode},
+		{"sslrootcert", c.settings.PgSslRootCert},
+		{"sslcert", c.settings.PgSslCert},
+		{"sslkey", c.settings.PgSslKey},
+		{"search_path", "klustercost,public"},
+	}
+
+	var parts []string
+	for _, setting := range settings {
+		if setting.value != "" {
+			parts = append(parts, setting.key+"="+quoteValue(setting.value))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// quoteValue quotes a connection string value, which may hold spaces or quotes
+func quoteValue(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
@@ -0,0 +1,103 @@
+package postgres
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// ErrCircuitOpen is returned without touching the database while it is known to be unreachable
+var ErrCircuitOpen = errors.New("postgres circuit breaker is open")
+
+// WriteError is returned by every failed operation of the postgres persistence
+// Transient errors are worth retrying, permanent ones will fail again
+type WriteError struct {
+	Op        string
+	Err       error
+	Transient bool
+}
+
+func (e *WriteError) Error() string {
+	kind := "permanent"
+	if e.Transient {
+		kind = "transient"
+	}
+	return fmt.Sprintf("postgres %s failed (%s): %v", e.Op, kind, e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether the operation may succeed when retried
+func (e *WriteError) Temporary() bool {
+	return e.Transient
+}
+
+// isTransient tells connectivity and contention failures apart from
+// failures caused by the data or the schema, which retrying cannot fix.
+func isTransient(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "08", // connection exception
+			"28", // invalid authorization: credentials rotated in the database before the files
+			"40", // transaction rollback: serialization failure, deadlock
+			"53", // insufficient resources
+			"57": // operator intervention: shutdown, cannot connect now
+			return true
+		default:
+			return false
+		}
+	}
+
+	var netErr net.Error
+	return errors.Is(err, ErrCircuitOpen) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &netErr)
+}
+
+// Number of consecutive transient failures after which the circuit opens
+const breakerThreshold = 5
+
+// breaker fails writes fast while the database is unreachable.
+// It opens after breakerThreshold consecutive transient failures
+// and closes again on the first successful ping or write.
+type breaker struct {
+	lock     sync.Mutex
+	failures int
+}
+
+func (b *breaker) allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures >= breakerThreshold {
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+func (b *breaker) success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures = 0
+}
+
+func (b *breaker) failure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures++
+}
+
+func (b *breaker) isOpen() bool {
+	return b.allow() != nil
+}
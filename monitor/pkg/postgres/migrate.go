@@ -0,0 +1,138 @@
+package postgres
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"klustercost/monitor/pkg/signals"
+)
+
+// The schema used by the monitor. Every file is named NNNN_description.sql
+// and is applied once, in version order. Applied files must never change;
+// schema changes go into a new file with the next version.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Arbitrary key of the advisory lock serializing migrations across replicas
+const migrationLockKey = 7531902468
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer monitor
+var ErrSchemaTooNew = errors.New("database schema is newer than this monitor supports")
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// loadMigrations returns the embedded migrations sorted by version
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	for _, entry := range entries {
+		version, name, found := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		if !found {
+			return nil, fmt.Errorf("migration %s is not named NNNN_description.sql", entry.Name())
+		}
+		number, err := strconv.Atoi(version)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has an invalid version: %w", entry.Name(), err)
+		}
+		sql, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: number, name: name, sql: string(sql)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for idx := 1; idx < len(migrations); idx++ {
+		if migrations[idx].version == migrations[idx-1].version {
+			return nil, fmt.Errorf("duplicate migration version %d", migrations[idx].version)
+		}
+	}
+	return migrations, nil
+}
+
+// Migrate applies the embedded migrations the database has not seen yet and
+// records them in klustercost.schema_migrations. It refuses to touch a
+// database whose schema is newer than the latest embedded migration.
+func (pg *persistence_pg) Migrate(ctx context.Context) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].version
+
+	// A dedicated connection, since advisory locks belong to the session
+	conn, err := pg.db_connection.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey)
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE SCHEMA IF NOT EXISTS klustercost;
+		CREATE TABLE IF NOT EXISTS klustercost.schema_migrations (
+			version integer PRIMARY KEY,
+			name character varying(253) NOT NULL,
+			applied_at timestamp without time zone NOT NULL DEFAULT now()
+		);`)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	err = conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM klustercost.schema_migrations").Scan(&current)
+	if err != nil {
+		return err
+	}
+	if current > latest {
+		return fmt.Errorf("%w: database is at version %d, latest known is %d", ErrSchemaTooNew, current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		signals.Logger.Info("Applying schema migration", "version", m.version, "name", m.name)
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "SET LOCAL search_path TO klustercost, public")
+		if err == nil {
+			_, err = tx.ExecContext(ctx, m.sql)
+		}
+		if err == nil {
+			_, err = tx.ExecContext(ctx, "INSERT INTO klustercost.schema_migrations (version, name) VALUES ($1, $2)", m.version, m.name)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d_%s: %w", m.version, m.name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d_%s: %w", m.version, m.name, err)
+		}
+	}
+
+	signals.Logger.Info("Database schema is up to date", "version", latest)
+	return nil
+}
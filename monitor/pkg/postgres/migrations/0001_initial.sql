@@ -1,4 +1,75 @@
+-- Schema as deployed by the Helm chart before the monitor managed migrations.
+-- Every statement tolerates a database that was initialized by the chart.
+
 CREATE SCHEMA IF NOT EXISTS klustercost;
+CREATE TABLE IF NOT EXISTS klustercost.tbl_nodes (
+    idx serial PRIMARY KEY,
+    node character varying (100),
+    mem double precision,
+    cpu double precision,
+    labels character varying(500),
+    "node.kubernetes.io/instance-type" character varying (100),
+    "topology.kubernetes.io/region" character varying (100),
+    "topology.kubernetes.io/zone" character varying (100),
+    "kubernetes.io/os" character varying (100),
+    price_per_hour double precision,
+    ended_at timestamp without time zone,
+    final_state character varying (63)
+);
+
+ALTER TABLE klustercost.tbl_nodes
+    ADD COLUMN IF NOT EXISTS ended_at timestamp without time zone,
+    ADD COLUMN IF NOT EXISTS final_state character varying (63);
+
+CREATE INDEX IF NOT EXISTS tbl_nodes_node
+    ON klustercost.tbl_nodes USING hash
+    (node COLLATE pg_catalog."default")
+    TABLESPACE pg_default;
+
+CREATE OR REPLACE PROCEDURE add_node(
+	IN arg_node character varying,
+	IN arg_mem double precision,
+	IN arg_cpu double precision,
+	IN arg_labels character varying,
+	IN arg_instance_type character varying,
+	IN arg_region character varying,
+	IN arg_zone character varying,
+	IN arg_os character varying)
+LANGUAGE 'plpgsql'
+AS $$
+declare
+  node_exists INTEGER;
+begin
+  SELECT COUNT(*) INTO node_exists FROM klustercost.tbl_nodes WHERE node = arg_node;
+  IF node_exists = 0 THEN
+    INSERT INTO klustercost.tbl_nodes (node, mem, cpu, labels,
+      "node.kubernetes.io/instance-type", "topology.kubernetes.io/region",
+      "topology.kubernetes.io/zone", "kubernetes.io/os")
+    VALUES (arg_node, arg_mem, arg_cpu, arg_labels,
+      arg_instance_type, arg_region, arg_zone, arg_os);
+  ELSE
+    -- A node that comes back under the same name is alive again
+    UPDATE klustercost.tbl_nodes SET ended_at = NULL, final_state = NULL
+      WHERE node = arg_node AND ended_at IS NOT NULL;
+  END IF;
+end;
+$$;
+
+CREATE OR REPLACE VIEW klustercost.tbl_nodes_verbose
+ AS
+ SELECT idx,
+    node,
+    mem,
+    cpu,
+    labels,
+    "node.kubernetes.io/instance-type",
+    "topology.kubernetes.io/region",
+    "topology.kubernetes.io/zone",
+    "kubernetes.io/os",
+    price_per_hour,
+    price_per_hour / mem AS mb_price_per_hour,
+    price_per_hour / cpu AS cpu_price_per_hour
+   FROM tbl_nodes;
 
 CREATE TABLE IF NOT EXISTS klustercost.tbl_pods
 (
@@ -12,9 +83,21 @@ CREATE TABLE IF NOT EXISTS klustercost.tbl_pods
     "app.version" character varying(63) COLLATE pg_catalog."default",
     "app.managed-by" character varying(63) COLLATE pg_catalog."default",
     "app.part-of" character varying(63) COLLATE pg_catalog."default",
+    "controller.kind" character varying(63) COLLATE pg_catalog."default",
+    "controller.name" character varying(253) COLLATE pg_catalog."default",
+    "controller.uid" character varying(63) COLLATE pg_catalog."default",
+    ended_at timestamp without time zone,
+    final_state character varying(63) COLLATE pg_catalog."default",
     CONSTRAINT tbl_pods_pkey PRIMARY KEY (uid)
 );
 
+ALTER TABLE klustercost.tbl_pods
+    ADD COLUMN IF NOT EXISTS "controller.kind" character varying(63) COLLATE pg_catalog."default",
+    ADD COLUMN IF NOT EXISTS "controller.name" character varying(253) COLLATE pg_catalog."default",
+    ADD COLUMN IF NOT EXISTS "controller.uid" character varying(63) COLLATE pg_catalog."default",
+    ADD COLUMN IF NOT EXISTS ended_at timestamp without time zone,
+    ADD COLUMN IF NOT EXISTS final_state character varying(63) COLLATE pg_catalog."default";
+
 CREATE INDEX IF NOT EXISTS tbl_pods_app_component
     ON klustercost.tbl_pods USING hash
     ("app.component" COLLATE pg_catalog."default")
@@ -25,6 +108,11 @@ CREATE INDEX IF NOT EXISTS tbl_pods_app_name
     ("app.name" COLLATE pg_catalog."default")
     TABLESPACE pg_default;    
 
+CREATE INDEX IF NOT EXISTS tbl_pods_controller_uid
+    ON klustercost.tbl_pods USING hash
+    ("controller.uid" COLLATE pg_catalog."default")
+    TABLESPACE pg_default;
+
 CREATE INDEX IF NOT EXISTS tbl_pods_namespace
     ON klustercost.tbl_pods USING hash
     (namespace COLLATE pg_catalog."default")
@@ -40,6 +128,7 @@ CREATE INDEX IF NOT EXISTS tbl_pods_uid
     (uid COLLATE pg_catalog."default")
     TABLESPACE pg_default;
 
+DROP TYPE IF EXISTS pod_type;
 create type pod_type as (
   uid text,
   name text,
@@ -49,7 +138,11 @@ create type pod_type as (
   "app.instance" text,
   "app.component" text,
   "app.version" text,
-  "app.managed-by" text
+  "app.managed-by" text,
+  "app.part-of" text,
+  "controller.kind" text,
+  "controller.name" text,
+  "controller.uid" text
 );
 
 CREATE TABLE IF NOT EXISTS klustercost.tbl_pod_data
@@ -79,6 +172,7 @@ CREATE INDEX IF NOT EXISTS tbl_pod_data_uid
     (uid COLLATE pg_catalog."default")
     TABLESPACE pg_default;
 
+DROP TYPE IF EXISTS pod_data_type;
 create type pod_data_type as (
   uid text,
   cpu double precision,
@@ -158,3 +252,40 @@ AS $BODY$
 		INSERT INTO tbl_pod_data (SELECT now(), (jsonb_populate_record(null::pod_data_type,pod_sample)).*);
 	END;
 $BODY$;
+
+CREATE OR REPLACE PROCEDURE klustercost.register_termination(
+	IN arg_kind character varying,
+	IN arg_uid character varying,
+	IN arg_name character varying,
+	IN arg_namespace character varying,
+	IN arg_timestamp timestamp with time zone,
+	IN arg_final_state character varying)
+LANGUAGE 'plpgsql'
+AS $BODY$
+	BEGIN
+		IF arg_kind = 'Pod' THEN
+			UPDATE klustercost.tbl_pods
+				SET ended_at = arg_timestamp::timestamp, final_state = arg_final_state
+				WHERE uid = arg_uid AND ended_at IS NULL;
+		ELSIF arg_kind = 'Node' THEN
+			UPDATE klustercost.tbl_nodes
+				SET ended_at = arg_timestamp::timestamp, final_state = arg_final_state
+				WHERE node = arg_name AND ended_at IS NULL;
+		END IF;
+	END;
+$BODY$;
+
+CREATE OR REPLACE PROCEDURE klustercost.register_pod_json_batch(
+	IN pod_samples jsonb)
+LANGUAGE 'plpgsql'
+AS $BODY$
+	BEGIN
+		INSERT INTO tbl_pods
+			SELECT (jsonb_populate_record(null::pod_type, sample->'pod')).*
+			FROM jsonb_array_elements(pod_samples) AS sample
+			ON CONFLICT (uid) DO NOTHING;
+		INSERT INTO tbl_pod_data
+			SELECT (sample->>'timestamp')::timestamp with time zone::timestamp, (jsonb_populate_record(null::pod_data_type, sample->'pod')).*
+			FROM jsonb_array_elements(pod_samples) AS sample;
+	END;
+$BODY$;
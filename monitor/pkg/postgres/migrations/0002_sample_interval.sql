@@ -0,0 +1,7 @@
+-- Seconds elapsed since the previous sample of the same pod,
+-- NULL for the first sample of a pod.
+ALTER TABLE klustercost.tbl_pod_data
+    ADD COLUMN IF NOT EXISTS sample_interval double precision;
+
+ALTER TYPE pod_data_type
+    ADD ATTRIBUTE sample_interval double precision;
@@ -0,0 +1,25 @@
+-- Nodes are stored from the JSON produced by the node transform, so a
+-- new node field only needs a column of the same name.
+ALTER TABLE klustercost.tbl_nodes
+    ADD COLUMN IF NOT EXISTS cpu_allocatable double precision,
+    ADD COLUMN IF NOT EXISTS mem_allocatable double precision;
+
+CREATE OR REPLACE PROCEDURE klustercost.register_node_json(
+	IN node_sample jsonb)
+LANGUAGE 'plpgsql'
+AS $BODY$
+	DECLARE
+		arg_node character varying := node_sample->>'node';
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM klustercost.tbl_nodes WHERE node = arg_node) THEN
+			INSERT INTO klustercost.tbl_nodes
+				SELECT (jsonb_populate_record(null::klustercost.tbl_nodes,
+					node_sample - 'ended_at' - 'final_state'
+					|| jsonb_build_object('idx', nextval(pg_get_serial_sequence('klustercost.tbl_nodes', 'idx'))))).*;
+		ELSE
+			-- A node that comes back under the same name is alive again
+			UPDATE klustercost.tbl_nodes SET ended_at = NULL, final_state = NULL
+				WHERE node = arg_node AND ended_at IS NOT NULL;
+		END IF;
+	END;
+$BODY$;
@@ -0,0 +1,58 @@
+-- Objects of the kinds listed in OBSERVED_KINDS. Their transforms must
+-- produce uid, name and, for namespaced kinds, namespace; the whole
+-- transformed JSON is kept in data.
+CREATE TABLE IF NOT EXISTS klustercost.tbl_objects (
+    idx serial PRIMARY KEY,
+    kind character varying (63) NOT NULL,
+    uid character varying (36) NOT NULL UNIQUE,
+    name character varying (253) NOT NULL,
+    namespace character varying (63),
+    data jsonb NOT NULL,
+    first_seen timestamp without time zone NOT NULL DEFAULT now(),
+    last_seen timestamp without time zone NOT NULL DEFAULT now(),
+    ended_at timestamp without time zone,
+    final_state character varying (63)
+);
+
+CREATE INDEX IF NOT EXISTS tbl_objects_kind
+    ON klustercost.tbl_objects (kind, namespace, name);
+
+CREATE OR REPLACE PROCEDURE klustercost.register_object_json(
+	IN arg_kind character varying,
+	IN object_sample jsonb)
+LANGUAGE 'plpgsql'
+AS $BODY$
+	BEGIN
+		INSERT INTO klustercost.tbl_objects (kind, uid, name, namespace, data)
+			VALUES (arg_kind, object_sample->>'uid', object_sample->>'name', object_sample->>'namespace', object_sample)
+			ON CONFLICT (uid) DO UPDATE
+				SET data = EXCLUDED.data, name = EXCLUDED.name, last_seen = now(),
+					ended_at = NULL, final_state = NULL;
+	END;
+$BODY$;
+
+CREATE OR REPLACE PROCEDURE klustercost.register_termination(
+	IN arg_kind character varying,
+	IN arg_uid character varying,
+	IN arg_name character varying,
+	IN arg_namespace character varying,
+	IN arg_timestamp timestamp with time zone,
+	IN arg_final_state character varying)
+LANGUAGE 'plpgsql'
+AS $BODY$
+	BEGIN
+		IF arg_kind = 'Pod' THEN
+			UPDATE klustercost.tbl_pods
+				SET ended_at = arg_timestamp::timestamp, final_state = arg_final_state
+				WHERE uid = arg_uid AND ended_at IS NULL;
+		ELSIF arg_kind = 'Node' THEN
+			UPDATE klustercost.tbl_nodes
+				SET ended_at = arg_timestamp::timestamp, final_state = arg_final_state
+				WHERE node = arg_name AND ended_at IS NULL;
+		ELSE
+			UPDATE klustercost.tbl_objects
+				SET ended_at = arg_timestamp::timestamp, final_state = arg_final_state
+				WHERE kind = arg_kind AND uid = arg_uid AND ended_at IS NULL;
+		END IF;
+	END;
+$BODY$;
@@ -0,0 +1,125 @@
+-- GPUs and the other extended resources listed in EXTENDED_RESOURCES.
+-- gpu sums the resources named */gpu; the extended_* columns hold every
+-- listed resource by name, in base units.
+ALTER TABLE klustercost.tbl_nodes
+    ADD COLUMN IF NOT EXISTS gpu double precision,
+    ADD COLUMN IF NOT EXISTS gpu_allocatable double precision,
+    ADD COLUMN IF NOT EXISTS extended_capacity jsonb,
+    ADD COLUMN IF NOT EXISTS extended_allocatable jsonb;
+
+-- resource_claims holds the DRA claims of the pod, from status.resourceClaimStatuses.
+-- The claims themselves are recorded in tbl_objects when resource.k8s.io
+-- resourceclaims are listed in OBSERVED_RESOURCES.
+ALTER TABLE klustercost.tbl_pod_data
+    ADD COLUMN IF NOT EXISTS gpu_request double precision,
+    ADD COLUMN IF NOT EXISTS gpu_limit double precision,
+    ADD COLUMN IF NOT EXISTS extended_requests jsonb,
+    ADD COLUMN IF NOT EXISTS extended_limits jsonb,
+    ADD COLUMN IF NOT EXISTS resource_claims jsonb;
+
+-- Same order as the columns, the samples are inserted positionally
+ALTER TYPE pod_data_type
+    ADD ATTRIBUTE gpu_request double precision,
+    ADD ATTRIBUTE gpu_limit double precision,
+    ADD ATTRIBUTE extended_requests jsonb,
+    ADD ATTRIBUTE extended_limits jsonb,
+    ADD ATTRIBUTE resource_claims jsonb;
+
+-- Settings of the cost calculation. gpu_price_share is the part of the
+-- price of a node with GPUs that is charged to its GPUs; the rest is
+-- split across CPU and memory as on any other node.
+CREATE TABLE IF NOT EXISTS klustercost.tbl_cost_settings (
+    name character varying (63) PRIMARY KEY,
+    value double precision NOT NULL
+);
+
+INSERT INTO klustercost.tbl_cost_settings (name, value)
+    VALUES ('gpu_price_share', 0.8)
+    ON CONFLICT (name) DO NOTHING;
+
+CREATE OR REPLACE VIEW klustercost.tbl_nodes_verbose
+ AS
+ SELECT idx,
+    node,
+    mem,
+    cpu,
+    labels,
+    "node.kubernetes.io/instance-type",
+    "topology.kubernetes.io/region",
+    "topology.kubernetes.io/zone",
+    "kubernetes.io/os",
+    price_per_hour,
+    price_per_hour * (1 - gpu_share) / mem AS mb_price_per_hour,
+    price_per_hour * (1 - gpu_share) / cpu AS cpu_price_per_hour,
+    gpu,
+    price_per_hour * gpu_share / NULLIF(gpu, 0) AS gpu_price_per_hour
+   FROM ( SELECT tbl_nodes.*,
+            CASE
+                WHEN COALESCE(gpu, 0) > 0 THEN COALESCE(
+                    (SELECT value FROM klustercost.tbl_cost_settings WHERE name = 'gpu_price_share'), 0)
+                ELSE 0
+            END AS gpu_share
+           FROM tbl_nodes) _;
+
+-- The pod price gains the GPU dimension, so the materialized view is rebuilt
+DROP VIEW IF EXISTS klustercost.tbl_pod_data_verbose;
+DROP MATERIALIZED VIEW IF EXISTS klustercost.tbl_pod_data_verbose_mv;
+
+CREATE MATERIALIZED VIEW klustercost.tbl_pod_data_verbose_mv
+TABLESPACE pg_default
+AS
+ SELECT
+ 	uid,
+    "timestamp",
+    cpu,
+    mem,
+    cpu_request,
+    cpu_limit,
+    mem_request,
+    mem_limit,
+    cpu_price,
+    mem_price,
+        CASE
+            WHEN cpu_price > mem_price THEN cpu_price
+            ELSE mem_price
+        END + COALESCE(gpu_price, 0) AS price,
+    "timestamp"::date AS date,
+    to_char("timestamp", 'HH24'::text)::integer AS hour,
+    gpu_request,
+    gpu_price
+   FROM ( SELECT
+   			tbl_pod_data.uid,
+            tbl_pod_data."timestamp",
+            tbl_pod_data.cpu,
+            tbl_pod_data.mem,
+            tbl_pod_data.cpu_request,
+            tbl_pod_data.cpu_limit,
+            tbl_pod_data.mem_request,
+            tbl_pod_data.mem_limit,
+            tbl_pod_data.cpu * tbl_nodes_verbose.cpu_price_per_hour AS cpu_price,
+            tbl_pod_data.mem * tbl_nodes_verbose.mb_price_per_hour AS mem_price,
+            tbl_pod_data.gpu_request,
+            tbl_pod_data.gpu_request * tbl_nodes_verbose.gpu_price_per_hour AS gpu_price
+           FROM tbl_pod_data
+             LEFT JOIN tbl_pods ON tbl_pod_data.uid = tbl_pods.uid
+             LEFT JOIN tbl_nodes_verbose ON tbl_pods.node::text = tbl_nodes_verbose.node::text) _;
+
+CREATE OR REPLACE VIEW klustercost.tbl_pod_data_verbose
+ AS
+ SELECT
+ 	uid,
+    "timestamp",
+    cpu,
+    mem,
+    cpu_request,
+    cpu_limit,
+    mem_request,
+    mem_limit,
+    cpu_price,
+    mem_price,
+    price,
+    date,
+    hour,
+    gpu_request,
+    gpu_price
+   FROM tbl_pod_data_verbose_mv;
@@ -0,0 +1,128 @@
+-- Ephemeral storage of the nodes, in MB
+ALTER TABLE klustercost.tbl_nodes
+    ADD COLUMN IF NOT EXISTS ephemeral_storage double precision,
+    ADD COLUMN IF NOT EXISTS ephemeral_storage_allocatable double precision;
+
+-- Ephemeral storage used and requested by the pod, in MB. The usage is the
+-- writable layers, logs and emptyDir volumes of the pod; it is NULL when
+-- the usage source does not measure it.
+ALTER TABLE klustercost.tbl_pod_data
+    ADD COLUMN IF NOT EXISTS ephemeral_storage double precision,
+    ADD COLUMN IF NOT EXISTS ephemeral_storage_request double precision,
+    ADD COLUMN IF NOT EXISTS ephemeral_storage_limit double precision;
+
+-- Same order as the columns, the samples are inserted positionally
+ALTER TYPE pod_data_type
+    ADD ATTRIBUTE ephemeral_storage double precision,
+    ADD ATTRIBUTE ephemeral_storage_request double precision,
+    ADD ATTRIBUTE ephemeral_storage_limit double precision;
+
+-- Price of a GB of node disk per hour, $0.10 per GB-month by default. The
+-- disk is charged on top of the price of the node rather than split from it.
+INSERT INTO klustercost.tbl_cost_settings (name, value)
+    VALUES ('disk_price_per_gb_hour', 0.000137)
+    ON CONFLICT (name) DO NOTHING;
+
+CREATE OR REPLACE VIEW klustercost.tbl_nodes_verbose
+ AS
+ SELECT idx,
+    node,
+    mem,
+    cpu,
+    labels,
+    "node.kubernetes.io/instance-type",
+    "topology.kubernetes.io/region",
+    "topology.kubernetes.io/zone",
+    "kubernetes.io/os",
+    price_per_hour,
+    price_per_hour * (1 - gpu_share) / mem AS mb_price_per_hour,
+    price_per_hour * (1 - gpu_share) / cpu AS cpu_price_per_hour,
+    gpu,
+    price_per_hour * gpu_share / NULLIF(gpu, 0) AS gpu_price_per_hour,
+    ephemeral_storage,
+    ephemeral_storage / 1024 * disk_price_per_gb_hour AS disk_price_per_hour,
+    disk_price_per_gb_hour / 1024 AS disk_mb_price_per_hour
+   FROM ( SELECT tbl_nodes.*,
+            CASE
+                WHEN COALESCE(gpu, 0) > 0 THEN COALESCE(
+                    (SELECT value FROM klustercost.tbl_cost_settings WHERE name = 'gpu_price_share'), 0)
+                ELSE 0
+            END AS gpu_share,
+            COALESCE(
+                (SELECT value FROM klustercost.tbl_cost_settings WHERE name = 'disk_price_per_gb_hour'), 0)
+                AS disk_price_per_gb_hour
+           FROM tbl_nodes) _;
+
+-- The pod price gains the disk dimension, so the materialized view is rebuilt.
+-- A pod pays for the larger of the disk it uses and the disk it requests.
+DROP VIEW IF EXISTS klustercost.tbl_pod_data_verbose;
+DROP MATERIALIZED VIEW IF EXISTS klustercost.tbl_pod_data_verbose_mv;
+
+CREATE MATERIALIZED VIEW klustercost.tbl_pod_data_verbose_mv
+TABLESPACE pg_default
+AS
+ SELECT
+ 	uid,
+    "timestamp",
+    cpu,
+    mem,
+    cpu_request,
+    cpu_limit,
+    mem_request,
+    mem_limit,
+    cpu_price,
+    mem_price,
+        CASE
+            WHEN cpu_price > mem_price THEN cpu_price
+            ELSE mem_price
+        END + COALESCE(gpu_price, 0) + COALESCE(disk_price, 0) AS price,
+    "timestamp"::date AS date,
+    to_char("timestamp", 'HH24'::text)::integer AS hour,
+    gpu_request,
+    gpu_price,
+    ephemeral_storage,
+    ephemeral_storage_request,
+    disk_price
+   FROM ( SELECT
+   			tbl_pod_data.uid,
+            tbl_pod_data."timestamp",
+            tbl_pod_data.cpu,
+            tbl_pod_data.mem,
+            tbl_pod_data.cpu_request,
+            tbl_pod_data.cpu_limit,
+            tbl_pod_data.mem_request,
+            tbl_pod_data.mem_limit,
+            tbl_pod_data.cpu * tbl_nodes_verbose.cpu_price_per_hour AS cpu_price,
+            tbl_pod_data.mem * tbl_nodes_verbose.mb_price_per_hour AS mem_price,
+            tbl_pod_data.gpu_request,
+            tbl_pod_data.gpu_request * tbl_nodes_verbose.gpu_price_per_hour AS gpu_price,
+            tbl_pod_data.ephemeral_storage,
+            tbl_pod_data.ephemeral_storage_request,
+            GREATEST(tbl_pod_data.ephemeral_storage, tbl_pod_data.ephemeral_storage_request)
+                * tbl_nodes_verbose.disk_mb_price_per_hour AS disk_price
+           FROM tbl_pod_data
+             LEFT JOIN tbl_pods ON tbl_pod_data.uid = tbl_pods.uid
+             LEFT JOIN tbl_nodes_verbose ON tbl_pods.node::text = tbl_nodes_verbose.node::text) _;
+
+CREATE OR REPLACE VIEW klustercost.tbl_pod_data_verbose
+ AS
+ SELECT
+ 	uid,
+    "timestamp",
+    cpu,
+    mem,
+    cpu_request,
+    cpu_limit,
+    mem_request,
+    mem_limit,
+    cpu_price,
+    mem_price,
+    price,
+    date,
+    hour,
+    gpu_request,
+    gpu_price,
+    ephemeral_storage,
+    ephemeral_storage_request,
+    disk_price
+   FROM tbl_pod_data_verbose_mv;
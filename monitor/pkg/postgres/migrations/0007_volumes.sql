@@ -0,0 +1,155 @@
+-- PersistentVolumeClaims sampled by the storage controller (STORAGE_COST),
+-- one row per claim with the attributes of its volume and StorageClass.
+CREATE TABLE IF NOT EXISTS klustercost.tbl_volumes (
+    idx serial PRIMARY KEY,
+    uid character varying (36) NOT NULL UNIQUE,
+    name character varying (253) NOT NULL,
+    namespace character varying (63) NOT NULL,
+    labels jsonb,
+    volume character varying (253),
+    storage_class character varying (253),
+    provisioner character varying (253),
+    access_modes jsonb,
+    volume_mode character varying (63),
+    reclaim_policy character varying (63),
+    first_seen timestamp without time zone NOT NULL DEFAULT now(),
+    last_seen timestamp without time zone NOT NULL DEFAULT now(),
+    ended_at timestamp without time zone,
+    final_state character varying (63)
+);
+
+CREATE INDEX IF NOT EXISTS tbl_volumes_namespace
+    ON klustercost.tbl_volumes (namespace, name);
+
+-- Samples of the claims, in MB. used is NULL unless the volume transform
+-- reads kubelet_volume_stats_used_bytes. The workload charged for the volume
+-- and the running pods mounting it are recorded with every sample, as they
+-- change over the life of the claim.
+CREATE TABLE IF NOT EXISTS klustercost.tbl_volume_data (
+    "timestamp" timestamp without time zone NOT NULL DEFAULT now(),
+    uid character varying (36) NOT NULL,
+    capacity double precision,
+    request double precision,
+    used double precision,
+    "controller.kind" character varying (63),
+    "controller.name" character varying (253),
+    "controller.uid" character varying (63),
+    pods jsonb,
+    sample_interval double precision,
+    CONSTRAINT fk_volume_uid FOREIGN KEY (uid)
+        REFERENCES klustercost.tbl_volumes (uid) MATCH SIMPLE
+        ON UPDATE NO ACTION
+        ON DELETE NO ACTION
+);
+
+CREATE INDEX IF NOT EXISTS tbl_volume_data_timestamp
+    ON klustercost.tbl_volume_data ("timestamp");
+
+CREATE INDEX IF NOT EXISTS tbl_volume_data_uid
+    ON klustercost.tbl_volume_data USING hash (uid);
+
+-- Price of a GB of a StorageClass per hour. Classes without a row are
+-- charged storage_price_per_gb_hour of tbl_cost_settings, $0.10 per
+-- GB-month by default.
+CREATE TABLE IF NOT EXISTS klustercost.tbl_storage_prices (
+    storage_class character varying (253) PRIMARY KEY,
+    price_per_gb_hour double precision NOT NULL
+);
+
+INSERT INTO klustercost.tbl_cost_settings (name, value)
+    VALUES ('storage_price_per_gb_hour', 0.000137)
+    ON CONFLICT (name) DO NOTHING;
+
+CREATE OR REPLACE PROCEDURE klustercost.register_volume_json(
+	IN volume_sample jsonb)
+LANGUAGE 'plpgsql'
+AS $BODY$
+	BEGIN
+		INSERT INTO klustercost.tbl_volumes (uid, name, namespace, labels, volume, storage_class,
+				provisioner, access_modes, volume_mode, reclaim_policy)
+			SELECT uid, name, namespace, labels, volume, storage_class,
+				provisioner, access_modes, volume_mode, reclaim_policy
+			FROM jsonb_populate_record(null::klustercost.tbl_volumes, volume_sample)
+			ON CONFLICT (uid) DO UPDATE
+				SET labels = EXCLUDED.labels, volume = EXCLUDED.volume,
+					storage_class = EXCLUDED.storage_class, provisioner = EXCLUDED.provisioner,
+					access_modes = EXCLUDED.access_modes, volume_mode = EXCLUDED.volume_mode,
+					reclaim_policy = EXCLUDED.reclaim_policy, last_seen = now(),
+					ended_at = NULL, final_state = NULL;
+		INSERT INTO klustercost.tbl_volume_data (uid, capacity, request, used,
+				"controller.kind", "controller.name", "controller.uid", pods, sample_interval)
+			SELECT uid, capacity, request, used,
+				"controller.kind", "controller.name", "controller.uid", pods, sample_interval
+			FROM jsonb_populate_record(null::klustercost.tbl_volume_data, volume_sample);
+	END;
+$BODY$;
+
+CREATE OR REPLACE PROCEDURE klustercost.register_termination(
+	IN arg_kind character varying,
+	IN arg_uid character varying,
+	IN arg_name character varying,
+	IN arg_namespace character varying,
+	IN arg_timestamp timestamp with time zone,
+	IN arg_final_state character varying)
+LANGUAGE 'plpgsql'
+AS $BODY$
+	BEGIN
+		IF arg_kind = 'Pod' THEN
+			UPDATE klustercost.tbl_pods
+				SET ended_at = arg_timestamp::timestamp, final_state = arg_final_state
+				WHERE uid = arg_uid AND ended_at IS NULL;
+		ELSIF arg_kind = 'Node' THEN
+			UPDATE klustercost.tbl_nodes
+				SET ended_at = arg_timestamp::timestamp, final_state = arg_final_state
+				WHERE node = arg_name AND ended_at IS NULL;
+		ELSIF arg_kind = 'Volume' THEN
+			UPDATE klustercost.tbl_volumes
+				SET ended_at = arg_timestamp::timestamp, final_state = arg_final_state
+				WHERE uid = arg_uid AND ended_at IS NULL;
+		ELSE
+			UPDATE klustercost.tbl_objects
+				SET ended_at = arg_timestamp::timestamp, final_state = arg_final_state
+				WHERE kind = arg_kind AND uid = arg_uid AND ended_at IS NULL;
+		END IF;
+	END;
+$BODY$;
+
+-- Samples priced by the StorageClass of the claim. A claim pays for the
+-- capacity of its volume, or for its request until the capacity is known,
+-- and is charged to its namespace and to the workload of the sample.
+CREATE OR REPLACE VIEW klustercost.tbl_volume_data_verbose
+ AS
+ SELECT
+ 	uid,
+    "timestamp",
+    name,
+    namespace,
+    storage_class,
+    provisioner,
+    "controller.kind",
+    "controller.name",
+    capacity,
+    request,
+    used,
+    price_per_gb_hour,
+    COALESCE(capacity, request) / 1024 * price_per_gb_hour AS price,
+    "timestamp"::date AS date,
+    to_char("timestamp", 'HH24'::text)::integer AS hour
+   FROM ( SELECT
+   			tbl_volume_data.uid,
+            tbl_volume_data."timestamp",
+            tbl_volumes.name,
+            tbl_volumes.namespace,
+            tbl_volumes.storage_class,
+            tbl_volumes.provisioner,
+            tbl_volume_data."controller.kind",
+            tbl_volume_data."controller.name",
+            tbl_volume_data.capacity,
+            tbl_volume_data.request,
+            tbl_volume_data.used,
+            COALESCE(tbl_storage_prices.price_per_gb_hour,
+                (SELECT value FROM klustercost.tbl_cost_settings WHERE name = 'storage_price_per_gb_hour'))
+                AS price_per_gb_hour
+           FROM tbl_volume_data
+             JOIN tbl_volumes ON tbl_volume_data.uid = tbl_volumes.uid
+             LEFT JOIN tbl_storage_prices ON tbl_volumes.storage_class::text = tbl_storage_prices.storage_class::text) _;
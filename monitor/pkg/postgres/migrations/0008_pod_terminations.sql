@@ -0,0 +1,67 @@
+-- The end of life of a pod can reach the database before its first sample
+-- does. The termination then creates the row of the pod instead of being
+-- lost, and the sample written later keeps the recorded end of life.
+CREATE OR REPLACE PROCEDURE klustercost.register_termination(
+	IN arg_kind character varying,
+	IN arg_uid character varying,
+	IN arg_name character varying,
+	IN arg_namespace character varying,
+	IN arg_timestamp timestamp with time zone,
+	IN arg_final_state character varying)
+LANGUAGE 'plpgsql'
+AS $BODY$
+	BEGIN
+		IF arg_kind = 'Pod' THEN
+			INSERT INTO klustercost.tbl_pods (uid, name, namespace, ended_at, final_state)
+				VALUES (arg_uid, arg_name, arg_namespace, arg_timestamp::timestamp, arg_final_state)
+				ON CONFLICT (uid) DO UPDATE
+					SET ended_at = EXCLUDED.ended_at, final_state = EXCLUDED.final_state
+					WHERE tbl_pods.ended_at IS NULL;
+		ELSIF arg_kind = 'Node' THEN
+			UPDATE klustercost.tbl_nodes
+				SET ended_at = arg_timestamp::timestamp, final_state = arg_final_state
+				WHERE node = arg_name AND ended_at IS NULL;
+		ELSIF arg_kind = 'Volume' THEN
+			UPDATE klustercost.tbl_volumes
+				SET ended_at = arg_timestamp::timestamp, final_state = arg_final_state
+				WHERE uid = arg_uid AND ended_at IS NULL;
+		ELSE
+			UPDATE klustercost.tbl_objects
+				SET ended_at = arg_timestamp::timestamp, final_state = arg_final_state
+				WHERE kind = arg_kind AND uid = arg_uid AND ended_at IS NULL;
+		END IF;
+	END;
+$BODY$;
+
+-- Batches hold pod samples and pod terminations in the order they were
+-- queued. Terminations are written after the samples of the batch, the
+-- first one of a pod wins like in register_termination.
+CREATE OR REPLACE PROCEDURE klustercost.register_pod_json_batch(
+	IN pod_samples jsonb)
+LANGUAGE 'plpgsql'
+AS $BODY$
+	BEGIN
+		INSERT INTO tbl_pods
+			SELECT (jsonb_populate_record(null::pod_type, sample->'pod')).*
+			FROM jsonb_array_elements(pod_samples) AS sample
+			WHERE sample ? 'pod'
+			ON CONFLICT (uid) DO NOTHING;
+		INSERT INTO tbl_pod_data
+			SELECT (sample->>'timestamp')::timestamp with time zone::timestamp, (jsonb_populate_record(null::pod_data_type, sample->'pod')).*
+			FROM jsonb_array_elements(pod_samples) AS sample
+			WHERE sample ? 'pod';
+		INSERT INTO tbl_pods (uid, name, namespace, ended_at, final_state)
+			SELECT DISTINCT ON (sample->'termination'->>'uid')
+				sample->'termination'->>'uid',
+				sample->'termination'->>'name',
+				NULLIF(sample->'termination'->>'namespace', ''),
+				(sample->'termination'->>'timestamp')::timestamp with time zone::timestamp,
+				NULLIF(sample->'termination'->>'final_state', '')
+			FROM jsonb_array_elements(pod_samples) WITH ORDINALITY AS _(sample, position)
+			WHERE sample ? 'termination'
+			ORDER BY sample->'termination'->>'uid', position
+			ON CONFLICT (uid) DO UPDATE
+				SET ended_at = EXCLUDED.ended_at, final_state = EXCLUDED.final_state
+				WHERE tbl_pods.ended_at IS NULL;
+	END;
+$BODY$;
@@ -0,0 +1,41 @@
+-- The time of the last sample of a node, the end of life of a node that
+-- vanished while the monitor was not running.
+ALTER TABLE IF EXISTS klustercost.tbl_nodes
+    ADD COLUMN IF NOT EXISTS last_seen timestamp without time zone;
+
+CREATE OR REPLACE PROCEDURE klustercost.register_node_json(
+	IN node_sample jsonb)
+LANGUAGE 'plpgsql'
+AS $BODY$
+	DECLARE
+		arg_node character varying := node_sample->>'node';
+		fields jsonb := node_sample - 'idx' - 'node' - 'ended_at' - 'final_state' - 'last_seen';
+		column_list text;
+		value_list text;
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM klustercost.tbl_nodes WHERE node = arg_node) THEN
+			INSERT INTO klustercost.tbl_nodes
+				SELECT (jsonb_populate_record(null::klustercost.tbl_nodes,
+					node_sample - 'ended_at' - 'final_state'
+					|| jsonb_build_object('idx', nextval(pg_get_serial_sequence('klustercost.tbl_nodes', 'idx')),
+						'last_seen', now()::timestamp))).*;
+			RETURN;
+		END IF;
+
+		SELECT string_agg(quote_ident(attname), ', ' ORDER BY attnum),
+				string_agg('r.' || quote_ident(attname), ', ' ORDER BY attnum)
+			INTO column_list, value_list
+			FROM pg_attribute
+			WHERE attrelid = 'klustercost.tbl_nodes'::regclass AND attnum > 0 AND NOT attisdropped
+				AND fields ? attname::text;
+
+		-- A node that comes back under the same name is alive again
+		UPDATE klustercost.tbl_nodes SET last_seen = now(), ended_at = NULL, final_state = NULL
+			WHERE node = arg_node;
+		IF column_list IS NOT NULL THEN
+			EXECUTE format('UPDATE klustercost.tbl_nodes AS t SET (%s) = (SELECT %s FROM jsonb_populate_record(t, $1) AS r) WHERE node = $2',
+					column_list, value_list)
+				USING fields, arg_node;
+		END IF;
+	END;
+$BODY$;
@@ -0,0 +1,74 @@
+-- A termination that reaches the database before the first sample of a pod
+-- creates a row with the uid, name and namespace only. The samples fill in
+-- the columns that row is missing, without overwriting the recorded ones.
+-- Rows with a node were written by a sample already and are left alone.
+CREATE OR REPLACE PROCEDURE klustercost.register_pod_json(
+	IN pod_sample jsonb)
+LANGUAGE 'plpgsql'
+AS $BODY$
+	BEGIN
+		INSERT INTO tbl_pods
+			SELECT (jsonb_populate_record(null::pod_type, pod_sample)).*
+			ON CONFLICT (uid) DO UPDATE
+				SET name = COALESCE(tbl_pods.name, EXCLUDED.name),
+					namespace = COALESCE(tbl_pods.namespace, EXCLUDED.namespace),
+					node = COALESCE(tbl_pods.node, EXCLUDED.node),
+					"app.name" = COALESCE(tbl_pods."app.name", EXCLUDED."app.name"),
+					"app.instance" = COALESCE(tbl_pods."app.instance", EXCLUDED."app.instance"),
+					"app.component" = COALESCE(tbl_pods."app.component", EXCLUDED."app.component"),
+					"app.version" = COALESCE(tbl_pods."app.version", EXCLUDED."app.version"),
+					"app.managed-by" = COALESCE(tbl_pods."app.managed-by", EXCLUDED."app.managed-by"),
+					"app.part-of" = COALESCE(tbl_pods."app.part-of", EXCLUDED."app.part-of"),
+					"controller.kind" = COALESCE(tbl_pods."controller.kind", EXCLUDED."controller.kind"),
+					"controller.name" = COALESCE(tbl_pods."controller.name", EXCLUDED."controller.name"),
+					"controller.uid" = COALESCE(tbl_pods."controller.uid", EXCLUDED."controller.uid")
+				WHERE tbl_pods.node IS NULL;
+		INSERT INTO tbl_pod_data (SELECT now(), (jsonb_populate_record(null::pod_data_type,pod_sample)).*);
+	END;
+$BODY$;
+
+-- A row is updated once per statement, so the pods of a batch are written
+-- from their first sample in it.
+CREATE OR REPLACE PROCEDURE klustercost.register_pod_json_batch(
+	IN pod_samples jsonb)
+LANGUAGE 'plpgsql'
+AS $BODY$
+	BEGIN
+		INSERT INTO tbl_pods
+			SELECT DISTINCT ON (sample->'pod'->>'uid') (jsonb_populate_record(null::pod_type, sample->'pod')).*
+			FROM jsonb_array_elements(pod_samples) WITH ORDINALITY AS _(sample, position)
+			WHERE sample ? 'pod'
+			ORDER BY sample->'pod'->>'uid', position
+			ON CONFLICT (uid) DO UPDATE
+				SET name = COALESCE(tbl_pods.name, EXCLUDED.name),
+					namespace = COALESCE(tbl_pods.namespace, EXCLUDED.namespace),
+					node = COALESCE(tbl_pods.node, EXCLUDED.node),
+					"app.name" = COALESCE(tbl_pods."app.name", EXCLUDED."app.name"),
+					"app.instance" = COALESCE(tbl_pods."app.instance", EXCLUDED."app.instance"),
+					"app.component" = COALESCE(tbl_pods."app.component", EXCLUDED."app.component"),
+					"app.version" = COALESCE(tbl_pods."app.version", EXCLUDED."app.version"),
+					"app.managed-by" = COALESCE(tbl_pods."app.managed-by", EXCLUDED."app.managed-by"),
+					"app.part-of" = COALESCE(tbl_pods."app.part-of", EXCLUDED."app.part-of"),
+					"controller.kind" = COALESCE(tbl_pods."controller.kind", EXCLUDED."controller.kind"),
+					"controller.name" = COALESCE(tbl_pods."controller.name", EXCLUDED."controller.name"),
+					"controller.uid" = COALESCE(tbl_pods."controller.uid", EXCLUDED."controller.uid")
+				WHERE tbl_pods.node IS NULL;
+		INSERT INTO tbl_pod_data
+			SELECT (sample->>'timestamp')::timestamp with time zone::timestamp, (jsonb_populate_record(null::pod_data_type, sample->'pod')).*
+			FROM jsonb_array_elements(pod_samples) AS sample
+			WHERE sample ? 'pod';
+		INSERT INTO tbl_pods (uid, name, namespace, ended_at, final_state)
+			SELECT DISTINCT ON (sample->'termination'->>'uid')
+				sample->'termination'->>'uid',
+				sample->'termination'->>'name',
+				NULLIF(sample->'termination'->>'namespace', ''),
+				(sample->'termination'->>'timestamp')::timestamp with time zone::timestamp,
+				NULLIF(sample->'termination'->>'final_state', '')
+			FROM jsonb_array_elements(pod_samples) WITH ORDINALITY AS _(sample, position)
+			WHERE sample ? 'termination'
+			ORDER BY sample->'termination'->>'uid', position
+			ON CONFLICT (uid) DO UPDATE
+				SET ended_at = EXCLUDED.ended_at, final_state = EXCLUDED.final_state
+				WHERE tbl_pods.ended_at IS NULL;
+	END;
+$BODY$;
@@ -0,0 +1,116 @@
+-- The prices of the verbose views are hourly rates. sample_interval, the
+-- seconds since the previous sample of the pod or claim, turns them into the
+-- cost of the time a sample stands for: price * sample_interval / 3600.
+DROP VIEW IF EXISTS klustercost.tbl_pod_data_verbose;
+DROP MATERIALIZED VIEW IF EXISTS klustercost.tbl_pod_data_verbose_mv;
+
+CREATE MATERIALIZED VIEW klustercost.tbl_pod_data_verbose_mv
+TABLESPACE pg_default
+AS
+ SELECT
+ 	uid,
+    "timestamp",
+    cpu,
+    mem,
+    cpu_request,
+    cpu_limit,
+    mem_request,
+    mem_limit,
+    cpu_price,
+    mem_price,
+        CASE
+            WHEN cpu_price > mem_price THEN cpu_price
+            ELSE mem_price
+        END + COALESCE(gpu_price, 0) + COALESCE(disk_price, 0) AS price,
+    "timestamp"::date AS date,
+    to_char("timestamp", 'HH24'::text)::integer AS hour,
+    gpu_request,
+    gpu_price,
+    ephemeral_storage,
+    ephemeral_storage_request,
+    disk_price,
+    sample_interval
+   FROM ( SELECT
+   			tbl_pod_data.uid,
+            tbl_pod_data."timestamp",
+            tbl_pod_data.cpu,
+            tbl_pod_data.mem,
+            tbl_pod_data.cpu_request,
+            tbl_pod_data.cpu_limit,
+            tbl_pod_data.mem_request,
+            tbl_pod_data.mem_limit,
+            tbl_pod_data.cpu * tbl_nodes_verbose.cpu_price_per_hour AS cpu_price,
+            tbl_pod_data.mem * tbl_nodes_verbose.mb_price_per_hour AS mem_price,
+            tbl_pod_data.gpu_request,
+            tbl_pod_data.gpu_request * tbl_nodes_verbose.gpu_price_per_hour AS gpu_price,
+            tbl_pod_data.ephemeral_storage,
+            tbl_pod_data.ephemeral_storage_request,
+            GREATEST(tbl_pod_data.ephemeral_storage, tbl_pod_data.ephemeral_storage_request)
+                * tbl_nodes_verbose.disk_mb_price_per_hour AS disk_price,
+            tbl_pod_data.sample_interval
+           FROM tbl_pod_data
+             LEFT JOIN tbl_pods ON tbl_pod_data.uid = tbl_pods.uid
+             LEFT JOIN tbl_nodes_verbose ON tbl_pods.node::text = tbl_nodes_verbose.node::text) _;
+
+CREATE OR REPLACE VIEW klustercost.tbl_pod_data_verbose
+ AS
+ SELECT
+ 	uid,
+    "timestamp",
+    cpu,
+    mem,
+    cpu_request,
+    cpu_limit,
+    mem_request,
+    mem_limit,
+    cpu_price,
+    mem_price,
+    price,
+    date,
+    hour,
+    gpu_request,
+    gpu_price,
+    ephemeral_storage,
+    ephemeral_storage_request,
+    disk_price,
+    sample_interval
+   FROM tbl_pod_data_verbose_mv;
+
+CREATE OR REPLACE VIEW klustercost.tbl_volume_data_verbose
+ AS
+ SELECT
+ 	uid,
+    "timestamp",
+    name,
+    namespace,
+    storage_class,
+    provisioner,
+    "controller.kind",
+    "controller.name",
+    capacity,
+    request,
+    used,
+    price_per_gb_hour,
+    COALESCE(capacity, request) / 1024 * price_per_gb_hour AS price,
+    "timestamp"::date AS date,
+    to_char("timestamp", 'HH24'::text)::integer AS hour,
+    sample_interval
+   FROM ( SELECT
+   			tbl_volume_data.uid,
+            tbl_volume_data."timestamp",
+            tbl_volumes.name,
+            tbl_volumes.namespace,
+            tbl_volumes.storage_class,
+            tbl_volumes.provisioner,
+            tbl_volume_data."controller.kind",
+            tbl_volume_data."controller.name",
+            tbl_volume_data.capacity,
+            tbl_volume_data.request,
+            tbl_volume_data.used,
+            COALESCE(tbl_storage_prices.price_per_gb_hour,
+                (SELECT value FROM klustercost.tbl_cost_settings WHERE name = 'storage_price_per_gb_hour'))
+                AS price_per_gb_hour,
+            tbl_volume_data.sample_interval
+           FROM tbl_volume_data
+             JOIN tbl_volumes ON tbl_volume_data.uid = tbl_volumes.uid
+             LEFT JOIN tbl_storage_prices ON tbl_volumes.storage_class::text = tbl_storage_prices.storage_class::text) _;
@@ -1,17 +1,31 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
+	"errors"
 	"klustercost/monitor/pkg/env"
 	"klustercost/monitor/pkg/model"
+	"klustercost/monitor/pkg/signals"
+	"math"
+	"time"
 
-	_ "github.com/lib/pq"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 )
 
+const (
+	// Interval between health pings of the database
+	pingInterval = 10 * time.Second
+	// Upper bound of a single statement, so a hung connection cannot stall a worker forever
+	statementTimeout = 30 * time.Second
+)
+
 type persistence_pg struct {
 	db_connection *sql.DB
+	breaker       breaker
+	buffer        *writeBuffer
+	done          chan struct{}
 }
 
 var persistence_impl *persistence_pg = nil
@@ -24,46 +38,207 @@ func ClosePersistInterface() {
 }
 func GetPersistInterface() interface{} {
 	if persistence_impl == nil {
-		env := env.NewConfiguration()
-		connectionString := fmt.Sprintf("user=%s password=%s dbname=%s host=%s port=%s sslmode=disable", env.PgDbUser, env.PgDbPass, env.PgDbName, env.PgDbHost, env.PgDbPort)
-		db_connection, err := sql.Open("postgres", connectionString)
-		if err != nil {
-			fmt.Println("Error opening the DB connection:", err)
-			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		env := env.EnvironmentVariables
+		db_connection := sql.OpenDB(newConnector(env))
+		db_connection.SetConnMaxLifetime(time.Duration(env.PgConnMaxLifetime) * time.Second)
+		persistence_impl = &persistence_pg{db_connection: db_connection, done: make(chan struct{})}
+		persistence_impl.migrateOnStartup()
+		if env.PgBatchSize > 1 {
+			persistence_impl.buffer = newWriteBuffer(persistence_impl, env.PgBatchSize, time.Duration(env.PgFlushInterval)*time.Second)
 		}
-		persistence_impl = &persistence_pg{db_connection}
+		go persistence_impl.pingLoop()
 	}
 
 	return persistence_impl
 }
 
+// migrateOnStartup waits for the database to be reachable and brings its
+// schema up to date. The monitor refuses to run against a schema it cannot
+// migrate, or one that is newer than it understands.
+func (pg *persistence_pg) migrateOnStartup() {
+	backoff := wait.Backoff{Duration: time.Second, Factor: 2, Steps: math.MaxInt32, Cap: time.Minute}
+	for {
+		err := pg.Migrate(signals.Ctx)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, ErrSchemaTooNew) || !isTransient(err) {
+			signals.Logger.Error(err, "Unable to migrate the database schema")
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+
+		delay := backoff.Step()
+		signals.Logger.Error(err, "Database not reachable for schema migration, retrying", "after", delay)
+		select {
+		case <-signals.Ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
 func (pg *persistence_pg) Close() {
+	if pg.buffer != nil {
+		pg.buffer.close()
+	}
+	close(pg.done)
 	persistence_impl.db_connection.Close()
 }
 
+// pingLoop keeps checking the database. database/sql reopens broken
+// connections on its own; the first successful ping after an outage
+// closes the circuit breaker so writes resume.
+func (pg *persistence_pg) pingLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pg.done:
+			return
+		case <-ticker.C:
+		}
+
+		err := pg.Ping()
+		wasOpen := pg.breaker.isOpen()
+		if err != nil {
+			pg.breaker.failure()
+			signals.Logger.Error(err, "Postgres health ping failed")
+			continue
+		}
+		pg.breaker.success()
+		if wasOpen {
+			signals.Logger.Info("Postgres reachable again, resuming writes")
+		}
+	}
+}
+
+// Ping checks that the database answers
+func (pg *persistence_pg) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), statementTimeout)
+	defer cancel()
+	return pg.db_connection.PingContext(ctx)
+}
+
+// exec runs a statement through the circuit breaker and classifies its failure
+func (pg *persistence_pg) exec(op string, query string, args ...any) error {
+	if err := pg.breaker.allow(); err != nil {
+		return &WriteError{Op: op, Err: err, Transient: true}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), statementTimeout)
+	defer cancel()
+
+	_, err := pg.db_connection.ExecContext(ctx, query, args...)
+	return pg.result(op, err)
+}
+
+// result feeds the outcome of an operation to the circuit breaker.
+// Permanent failures prove the database is reachable, so they count as success.
+func (pg *persistence_pg) result(op string, err error) error {
+	if err == nil {
+		pg.breaker.success()
+		return nil
+	}
+
+	writeErr := &WriteError{Op: op, Err: err, Transient: isTransient(err)}
+	if writeErr.Transient {
+		pg.breaker.failure()
+	} else {
+		pg.breaker.success()
+	}
+	return writeErr
+}
+
 // This function inserts the details of a pod into the database
-// It calls the klustercost.register_pod_data_json stored procedure
+// It calls the klustercost.register_pod_data_json stored procedure, or queues the
+// sample for klustercost.register_pod_json_batch when batching is enabled
 func (pg *persistence_pg) InsertPodJson(pod_json string) error {
-	_, err := pg.db_connection.Exec("CALL klustercost.register_pod_json($1)", pod_json)
-	if err != nil {
-		fmt.Println("Error inserting pod details into the database:", err)
-		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
-		return err
+	if pg.buffer != nil {
+		return pg.buffer.add(pod_json)
 	}
-	return nil
+	return pg.exec("insert pod", "CALL klustercost.register_pod_json($1)", pod_json)
 }
 
 // This function inserts the details of a node into the database
-// price_per_hour to be added to the function argument and to the query once it is actually defined
-func (pg *persistence_pg) InsertNode(node_name string, nodeMisc *model.NodeMisc) error {
-	_, err := pg.db_connection.Exec("CALL add_node($1, $2, $3, NULLIF($4,''), NULLIF($5,''), NULLIF($6,''), NULLIF($7,''), NULLIF($8,''))",
-		node_name, nodeMisc.Memory, nodeMisc.CPU,
-		nodeMisc.Labels, nodeMisc.InstanceType, nodeMisc.Region, nodeMisc.Zone, nodeMisc.OS)
+// It calls the klustercost.register_node_json stored procedure
+func (pg *persistence_pg) InsertNodeJson(node_json string) error {
+	return pg.exec("insert node", "CALL klustercost.register_node_json($1)", node_json)
+}
+
+// This function inserts a sample of a PersistentVolumeClaim into the database
+// It calls the klustercost.register_volume_json stored procedure
+func (pg *persistence_pg) InsertVolumeJson(volume_json string) error {
+	return pg.exec("insert volume", "CALL klustercost.register_volume_json($1)", volume_json)
+}
+
+// This function inserts or refreshes an object of any other kind
+// It calls the klustercost.register_object_json stored procedure
+func (pg *persistence_pg) InsertObjectJson(kind string, object_json string) error {
+	return pg.exec("insert object", "CALL klustercost.register_object_json($1, $2)", kind, object_json)
+}
+
+// This function records the end of life of an object
+// It calls the klustercost.register_termination stored procedure. With
+// batching, pod terminations are queued behind the samples of the pod and
+// written by klustercost.register_pod_json_batch instead.
+func (pg *persistence_pg) RecordTermination(termination *model.Termination) error {
+	if pg.buffer != nil && termination.Kind == model.KindPod {
+		return pg.buffer.addTermination(termination)
+	}
+	err := pg.exec("record termination", "CALL klustercost.register_termination($1, NULLIF($2,''), $3, NULLIF($4,''), $5, NULLIF($6,''))",
+		termination.Kind, termination.UID, termination.Name, termination.Namespace,
+		termination.Timestamp, termination.FinalState)
 	if err != nil {
-		fmt.Println("Error inserting node details into the database:", err)
-		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 		return err
 	}
-	fmt.Println("INSERTED Node:", node_name, "memory", nodeMisc.Memory, "CPU", nodeMisc.CPU, "labels", nodeMisc.Labels)
+	signals.Logger.V(2).Info("Recorded termination", "kind", termination.Kind, "namespace", termination.Namespace, "name", termination.Name, "state", termination.FinalState)
 	return nil
 }
+
+// This function lists the objects of a kind that have no end of life recorded
+// and the time of their last sample
+func (pg *persistence_pg) ListActive(kind string) ([]model.ActiveObject, error) {
+	var query string
+	var args []any
+	// The timestamps are stored in the time zone of the session, the cast
+	// to timestamptz gives them back as instants
+	switch kind {
+	case model.KindPod:
+		query = `SELECT uid, COALESCE(name, ''), COALESCE(namespace, ''),
+				(SELECT max("timestamp") FROM klustercost.tbl_pod_data AS d WHERE d.uid = p.uid)::timestamptz
+			FROM klustercost.tbl_pods AS p WHERE ended_at IS NULL`
+	case model.KindNode:
+		query = "SELECT '', node, '', last_seen::timestamptz FROM klustercost.tbl_nodes WHERE ended_at IS NULL"
+	case model.KindVolume:
+		query = "SELECT uid, name, namespace, last_seen::timestamptz FROM klustercost.tbl_volumes WHERE ended_at IS NULL"
+	default:
+		query = "SELECT uid, name, COALESCE(namespace, ''), last_seen::timestamptz FROM klustercost.tbl_objects WHERE kind = $1 AND ended_at IS NULL"
+		args = append(args, kind)
+	}
+
+	if err := pg.breaker.allow(); err != nil {
+		return nil, &WriteError{Op: "list active", Err: err, Transient: true}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), statementTimeout)
+	defer cancel()
+
+	rows, err := pg.db_connection.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, pg.result("list active", err)
+	}
+	defer rows.Close()
+
+	var objects []model.ActiveObject
+	for rows.Next() {
+		object := model.ActiveObject{ObjectRef: model.ObjectRef{Kind: kind}}
+		var last_seen sql.NullTime
+		if err := rows.Scan(&object.UID, &object.Name, &object.Namespace, &last_seen); err != nil {
+			return nil, pg.result("list active", err)
+		}
+		object.LastSeen = last_seen.Time
+		objects = append(objects, object)
+	}
+	return objects, pg.result("list active", rows.Err())
+}
@@ -0,0 +1,173 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"klustercost/monitor/pkg/model"
+)
+
+// testDatabase migrates the database named by KLUSTERCOST_TEST_DATABASE, a
+// key=value connection string, e.g. "host=localhost user=postgres
+// password=admin dbname=klustercost_test sslmode=disable". The klustercost
+// schema is dropped first, so never point it at a database in use.
+func testDatabase(t *testing.T) *persistence_pg {
+	t.Helper()
+	dsn := os.Getenv("KLUSTERCOST_TEST_DATABASE")
+	if dsn == "" {
+		t.Skip("KLUSTERCOST_TEST_DATABASE not set")
+	}
+
+	db, err := sql.Open("postgres", dsn+" search_path=klustercost,public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS klustercost CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+
+	pg := &persistence_pg{db_connection: db, done: make(chan struct{})}
+	if err := pg.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return pg
+}
+
+func TestRegisterNodeJsonRefreshesNode(t *testing.T) {
+	pg := testDatabase(t)
+
+	samples := []string{
+		`{"node":"node-a","cpu":4,"mem":16384,"cpu_allocatable":3.9,"labels":"kubernetes.io/os=linux"}`,
+		`{"node":"node-a","cpu":4,"mem":16384,"cpu_allocatable":3.5,"labels":"kubernetes.io/os=linux,topology.kubernetes.io/zone=a"}`,
+	}
+	for _, sample := range samples {
+		if err := pg.InsertNodeJson(sample); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var rows int
+	var allocatable float64
+	var labels string
+	err := pg.db_connection.QueryRow(
+		"SELECT count(*), max(cpu_allocatable), max(labels) FROM klustercost.tbl_nodes WHERE node = 'node-a'").
+		Scan(&rows, &allocatable, &labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Errorf("got %d rows for the node, want 1", rows)
+	}
+	if allocatable != 3.5 {
+		t.Errorf("got cpu_allocatable %v, want 3.5", allocatable)
+	}
+	if labels != "kubernetes.io/os=linux,topology.kubernetes.io/zone=a" {
+		t.Errorf("got labels %q, want the labels of the last sample", labels)
+	}
+}
+
+// Objects that vanished while the monitor was down are closed at the time of
+// their last sample, ListActive must return it
+func TestListActiveReturnsLastSeen(t *testing.T) {
+	pg := testDatabase(t)
+
+	before := time.Now().Add(-time.Second)
+	if err := pg.InsertPodJson(`{"uid":"pod-a","name":"a","namespace":"default","cpu":0.5,"mem":128}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := pg.InsertNodeJson(`{"node":"node-a","cpu":4,"mem":16384}`); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now().Add(time.Second)
+
+	for _, kind := range []string{model.KindPod, model.KindNode} {
+		active, err := pg.ListActive(kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(active) != 1 {
+			t.Fatalf("%s: got %d active objects, want 1", kind, len(active))
+		}
+		if seen := active[0].LastSeen; seen.Before(before) || seen.After(after) {
+			t.Errorf("%s: got last seen %v, want the time of the sample", kind, seen)
+		}
+	}
+}
+
+// A termination can create the row of a pod before its first sample, the
+// samples must still fill in the node, app and controller of the pod
+func TestPodSamplesFillInPodsCreatedByTerminations(t *testing.T) {
+	pg := testDatabase(t)
+
+	ended := time.Now().Add(-time.Minute)
+	for _, uid := range []string{"pod-a", "pod-b"} {
+		termination := &model.Termination{
+			ObjectRef:  model.ObjectRef{Kind: model.KindPod, UID: uid, Name: uid, Namespace: "default"},
+			Timestamp:  ended,
+			FinalState: "Succeeded",
+		}
+		if err := pg.RecordTermination(termination); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sample := func(uid string) string {
+		return `{"uid":"` + uid + `","name":"` + uid + `","namespace":"default","node":"node-a","app.name":"web",` +
+			`"controller.kind":"Deployment","controller.name":"web","controller.uid":"deploy-a","cpu":0.5,"mem":128}`
+	}
+	if err := pg.InsertPodJson(sample("pod-a")); err != nil {
+		t.Fatal(err)
+	}
+	buffer := &writeBuffer{pg: pg, batchSize: 10}
+	batch := []podSample{
+		{Timestamp: time.Now(), Pod: json.RawMessage(sample("pod-b"))},
+		{Timestamp: time.Now(), Pod: json.RawMessage(sample("pod-b"))},
+	}
+	if consumed, err := buffer.write(batch); err != nil || consumed != len(batch) {
+		t.Fatalf("got %d samples written and %v, want %d", consumed, err, len(batch))
+	}
+
+	for _, uid := range []string{"pod-a", "pod-b"} {
+		var node, app, controller string
+		var ended_at sql.NullTime
+		err := pg.db_connection.QueryRow(
+			`SELECT node, "app.name", "controller.uid", ended_at FROM klustercost.tbl_pods WHERE uid = $1`, uid).
+			Scan(&node, &app, &controller, &ended_at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node != "node-a" || app != "web" || controller != "deploy-a" {
+			t.Errorf("%s: got node %q, app %q, controller %q, want the values of the sample", uid, node, app, controller)
+		}
+		if !ended_at.Valid {
+			t.Errorf("%s: lost the recorded end of life", uid)
+		}
+	}
+}
+
+// The prices of the verbose view are rates, sample_interval weights them
+func TestPodDataVerboseCarriesSampleInterval(t *testing.T) {
+	pg := testDatabase(t)
+
+	if err := pg.InsertPodJson(`{"uid":"pod-a","name":"a","namespace":"default","cpu":0.5,"mem":128,"sample_interval":300}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pg.db_connection.Exec("REFRESH MATERIALIZED VIEW klustercost.tbl_pod_data_verbose_mv"); err != nil {
+		t.Fatal(err)
+	}
+
+	var interval float64
+	err := pg.db_connection.QueryRow(
+		"SELECT sample_interval FROM klustercost.tbl_pod_data_verbose WHERE uid = 'pod-a'").Scan(&interval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if interval != 300 {
+		t.Errorf("got sample_interval %v, want 300", interval)
+	}
+}
@@ -0,0 +1,301 @@
+package prometheus_exporter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"klustercost/monitor/pkg/env"
+	"klustercost/monitor/pkg/model"
+	"klustercost/monitor/pkg/signals"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Labels attached to every pod gauge, taken from the transformed pod JSON.
+// The uid keeps the series of a pod recreated under the same name apart
+// until the termination of the previous one is processed.
+var podLabels = []string{
+	"namespace", "pod", "uid", "node",
+	"app_name", "app_instance", "app_component", "app_version", "app_part_of", "app_managed_by",
+	"controller_kind", "controller_name",
+}
+
+// Keys of the transformed pod JSON holding the pod labels, in podLabels order
+var podLabelKeys = []string{
+	"namespace", "name", "uid", "node",
+	"app.name", "app.instance", "app.component", "app.version", "app.part-of", "app.managed-by",
+	"controller.kind", "controller.name",
+}
+
+// Labels attached to every node gauge
+var nodeLabels = []string{"node", "instance_type", "region", "zone", "os"}
+
+// Keys of the transformed node JSON holding the node labels, in nodeLabels order
+var nodeLabelKeys = []string{
+	"node", "node.kubernetes.io/instance-type", "topology.kubernetes.io/region", "topology.kubernetes.io/zone", "kubernetes.io/os",
+}
+
+// Labels attached to every volume gauge
+var volumeLabels = []string{"namespace", "persistentvolumeclaim", "uid", "storage_class", "controller_kind", "controller_name"}
+
+// Keys of the transformed volume JSON holding the volume labels, in volumeLabels order
+var volumeLabelKeys = []string{"namespace", "name", "uid", "storage_class", "controller.kind", "controller.name"}
+
+// gauge maps a numeric key of the transformed JSON to a gauge
+type gauge struct {
+	key  string
+	desc *prometheus.Desc
+}
+
+var podGauges = []gauge{
+	{"cpu", prometheus.NewDesc("klustercost_pod_cpu_cores", "CPU used by the pod, in cores.", podLabels, nil)},
+	{"mem", prometheus.NewDesc("klustercost_pod_memory_mb", "Memory used by the pod, in MB.", podLabels, nil)},
+	{"cpu_request", prometheus.NewDesc("klustercost_pod_cpu_request_cores", "CPU requested by the pod, in cores.", podLabels, nil)},
+	{"cpu_limit", prometheus.NewDesc("klustercost_pod_cpu_limit_cores", "CPU limit of the pod, in cores.", podLabels, nil)},
+	{"mem_request", prometheus.NewDesc("klustercost_pod_memory_request_mb", "Memory requested by the pod, in MB.", podLabels, nil)},
+	{"mem_limit", prometheus.NewDesc("klustercost_pod_memory_limit_mb", "Memory limit of the pod, in MB.", podLabels, nil)},
+	{"gpu_request", prometheus.NewDesc("klustercost_pod_gpu_request", "GPUs requested by the pod.", podLabels, nil)},
+	{"ephemeral_storage", prometheus.NewDesc("klustercost_pod_ephemeral_storage_mb", "Ephemeral storage used by the pod, in MB.", podLabels, nil)},
+	{"ephemeral_storage_request", prometheus.NewDesc("klustercost_pod_ephemeral_storage_request_mb", "Ephemeral storage requested by the pod, in MB.", podLabels, nil)},
+}
+
+var nodeGauges = []gauge{
+	{"cpu", prometheus.NewDesc("klustercost_node_cpu_capacity_cores", "CPU capacity of the node, in cores.", nodeLabels, nil)},
+	{"mem", prometheus.NewDesc("klustercost_node_memory_capacity_mb", "Memory capacity of the node, in MB.", nodeLabels, nil)},
+	{"cpu_allocatable", prometheus.NewDesc("klustercost_node_cpu_allocatable_cores", "CPU of the node available to pods, in cores.", nodeLabels, nil)},
+	{"mem_allocatable", prometheus.NewDesc("klustercost_node_memory_allocatable_mb", "Memory of the node available to pods, in MB.", nodeLabels, nil)},
+	{"gpu", prometheus.NewDesc("klustercost_node_gpu_capacity", "GPUs of the node.", nodeLabels, nil)},
+	{"gpu_allocatable", prometheus.NewDesc("klustercost_node_gpu_allocatable", "GPUs of the node available to pods.", nodeLabels, nil)},
+	{"ephemeral_storage", prometheus.NewDesc("klustercost_node_ephemeral_storage_capacity_mb", "Ephemeral storage capacity of the node, in MB.", nodeLabels, nil)},
+	{"ephemeral_storage_allocatable", prometheus.NewDesc("klustercost_node_ephemeral_storage_allocatable_mb", "Ephemeral storage of the node available to pods, in MB.", nodeLabels, nil)},
+}
+
+var volumeGauges = []gauge{
+	{"capacity", prometheus.NewDesc("klustercost_volume_capacity_mb", "Capacity of the volume bound to the claim, in MB.", volumeLabels, nil)},
+	{"request", prometheus.NewDesc("klustercost_volume_request_mb", "Storage requested by the claim, in MB.", volumeLabels, nil)},
+	{"used", prometheus.NewDesc("klustercost_volume_used_mb", "Storage used on the volume, in MB, when the transform provides it.", volumeLabels, nil)},
+}
+
+// SampleError is returned for a sample the exporter cannot read. The same
+// sample fails again when retried, so the error is permanent.
+type SampleError struct {
+	Kind string
+	Err  error
+}
+
+func (e *SampleError) Error() string {
+	return fmt.Sprintf("prometheus exporter: invalid %s sample: %v", e.Kind, e.Err)
+}
+
+func (e *SampleError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports that retrying the sample cannot help
+func (e *SampleError) Temporary() bool {
+	return false
+}
+
+// sample is the latest state of a pod, node or volume: its label values and its gauges
+type sample struct {
+	labels []string
+	values map[string]float64
+}
+
+// newSample extracts the labels and the gauge values from a transformed JSON object
+func newSample(object model.DataExchange, labelKeys []string, gauges []gauge) *sample {
+	s := &sample{
+		labels: make([]string, len(labelKeys)),
+		values: make(map[string]float64),
+	}
+	for idx, key := range labelKeys {
+		if value, exists := object[key]; exists && value != nil {
+			s.labels[idx] = fmt.Sprintf("%v", value)
+		}
+	}
+	for _, gauge := range gauges {
+		if value, ok := object[gauge.key].(float64); ok {
+			s.values[gauge.key] = value
+		}
+	}
+	return s
+}
+
+// collect sends one const gauge per value of the sample
+func (s *sample) collect(ch chan<- prometheus.Metric, gauges []gauge) {
+	for _, gauge := range gauges {
+		if value, exists := s.values[gauge.key]; exists {
+			ch <- prometheus.MustNewConstMetric(gauge.desc, prometheus.GaugeValue, value, s.labels...)
+		}
+	}
+}
+
+// persistence_prom keeps the latest sample of every node, pod and volume in memory
+// and serves them as gauges on the /metrics endpoint.
+type persistence_prom struct {
+	lock    sync.RWMutex
+	pods    map[string]*sample
+	nodes   map[string]*sample
+	volumes map[string]*sample
+	server  *http.Server
+}
+
+var persistence_impl *persistence_prom = nil
+
+// Stops serving the metrics endpoint.
+func ClosePersistInterface() {
+	if persistence_impl != nil {
+		persistence_impl.Close()
+	}
+}
+
+func GetPersistInterface() interface{} {
+	if persistence_impl == nil {
+		persistence_impl = &persistence_prom{
+			pods:    make(map[string]*sample),
+			nodes:   make(map[string]*sample),
+			volumes: make(map[string]*sample),
+		}
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(persistence_impl)
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+		persistence_impl.server = &http.Server{Addr: env.EnvironmentVariables.ExporterAddress, Handler: mux}
+
+		go func() {
+			signals.Logger.Info("Serving metrics", "address", persistence_impl.server.Addr)
+			if err := persistence_impl.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				signals.Logger.Error(err, "Metrics endpoint stopped")
+			}
+		}()
+	}
+
+	return persistence_impl
+}
+
+func (p *persistence_prom) Close() {
+	p.server.Close()
+}
+
+// Describe implements prometheus.Collector
+func (p *persistence_prom) Describe(ch chan<- *prometheus.Desc) {
+	for _, gauge := range podGauges {
+		ch <- gauge.desc
+	}
+	for _, gauge := range nodeGauges {
+		ch <- gauge.desc
+	}
+	for _, gauge := range volumeGauges {
+		ch <- gauge.desc
+	}
+}
+
+// Collect implements prometheus.Collector
+func (p *persistence_prom) Collect(ch chan<- prometheus.Metric) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	for _, sample := range p.pods {
+		sample.collect(ch, podGauges)
+	}
+	for _, sample := range p.nodes {
+		sample.collect(ch, nodeGauges)
+	}
+	for _, sample := range p.volumes {
+		sample.collect(ch, volumeGauges)
+	}
+}
+
+// This function keeps the latest sample of a pod
+// Numeric keys without a matching gauge are ignored
+func (p *persistence_prom) InsertPodJson(pod_json string) error {
+	var pod model.DataExchange
+	if err := json.Unmarshal([]byte(pod_json), &pod); err != nil {
+		return &SampleError{Kind: "pod", Err: err}
+	}
+
+	uid, ok := pod["uid"].(string)
+	if !ok {
+		return &SampleError{Kind: "pod", Err: fmt.Errorf("no uid in %s", pod_json)}
+	}
+
+	p.lock.Lock()
+	p.pods[uid] = newSample(pod, podLabelKeys, podGauges)
+	p.lock.Unlock()
+	return nil
+}
+
+// This function keeps the latest capacity of a node
+// Numeric keys without a matching gauge are ignored
+func (p *persistence_prom) InsertNodeJson(node_json string) error {
+	var node model.DataExchange
+	if err := json.Unmarshal([]byte(node_json), &node); err != nil {
+		return &SampleError{Kind: "node", Err: err}
+	}
+
+	name, ok := node["node"].(string)
+	if !ok {
+		return &SampleError{Kind: "node", Err: fmt.Errorf("no node name in %s", node_json)}
+	}
+
+	p.lock.Lock()
+	p.nodes[name] = newSample(node, nodeLabelKeys, nodeGauges)
+	p.lock.Unlock()
+	return nil
+}
+
+// This function keeps the latest sample of a PersistentVolumeClaim
+// Numeric keys without a matching gauge are ignored
+func (p *persistence_prom) InsertVolumeJson(volume_json string) error {
+	var volume model.DataExchange
+	if err := json.Unmarshal([]byte(volume_json), &volume); err != nil {
+		return &SampleError{Kind: "volume", Err: err}
+	}
+
+	uid, ok := volume["uid"].(string)
+	if !ok {
+		return &SampleError{Kind: "volume", Err: fmt.Errorf("no uid in %s", volume_json)}
+	}
+
+	p.lock.Lock()
+	p.volumes[uid] = newSample(volume, volumeLabelKeys, volumeGauges)
+	p.lock.Unlock()
+	return nil
+}
+
+// Only pods, nodes and volumes are exported, other kinds are ignored
+func (p *persistence_prom) InsertObjectJson(kind string, object_json string) error {
+	return nil
+}
+
+// This function stops exporting a pod, node or volume once it no longer exists
+func (p *persistence_prom) RecordTermination(termination *model.Termination) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	switch termination.Kind {
+	case model.KindPod:
+		delete(p.pods, termination.UID)
+	case model.KindNode:
+		delete(p.nodes, termination.Name)
+	case model.KindVolume:
+		delete(p.volumes, termination.UID)
+	}
+	return nil
+}
+
+// Samples are kept in memory only, so nothing outlives a restart
+func (p *persistence_prom) ListActive(kind string) ([]model.ActiveObject, error) {
+	return nil, nil
+}
+
+// The samples are served from memory, there is nothing to reach
+func (p *persistence_prom) Ping() error {
+	return nil
+}
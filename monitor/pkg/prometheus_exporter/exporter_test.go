@@ -0,0 +1,41 @@
+package prometheus_exporter
+
+import (
+	"errors"
+	"testing"
+)
+
+// Samples the exporter cannot read must not be retried, by the controllers
+// nor by the sink of a secondary backend
+func TestInvalidSamplesArePermanent(t *testing.T) {
+	p := &persistence_prom{
+		pods:    make(map[string]*sample),
+		nodes:   make(map[string]*sample),
+		volumes: make(map[string]*sample),
+	}
+
+	tests := []struct {
+		name  string
+		write func() error
+	}{
+		{"pod not JSON", func() error { return p.InsertPodJson("{") }},
+		{"pod without uid", func() error { return p.InsertPodJson(`{"name":"a"}`) }},
+		{"node not JSON", func() error { return p.InsertNodeJson("{") }},
+		{"node without name", func() error { return p.InsertNodeJson(`{"cpu":4}`) }},
+		{"volume not JSON", func() error { return p.InsertVolumeJson("{") }},
+		{"volume without uid", func() error { return p.InsertVolumeJson(`{"name":"data"}`) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.write()
+			var temporary interface{ Temporary() bool }
+			if !errors.As(err, &temporary) || temporary.Temporary() {
+				t.Errorf("got %v, want a permanent error", err)
+			}
+		})
+	}
+
+	if err := p.InsertPodJson(`{"uid":"a","cpu":0.5}`); err != nil {
+		t.Errorf("got %v for a valid sample", err)
+	}
+}